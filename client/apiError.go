@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"net/http"
+
+	"github.com/pkg/errors"
 )
 
 type ApiError struct {
@@ -20,7 +22,8 @@ func (e *ApiError) Error() string {
 	return e.Msg
 }
 
-func newApiError(resp *http.Response, url string) *ApiError {
+// NewApiError reads the body of a failed response and formats it into an ApiError.
+func NewApiError(resp *http.Response, url string) *ApiError {
 	contents, err := ioutil.ReadAll(resp.Body)
 	var body string
 	if err != nil {
@@ -59,8 +62,9 @@ func newApiError(resp *http.Response, url string) *ApiError {
 	}
 }
 
+// IsNotFound reports whether err, or the error it wraps, is an *ApiError with a 404 status code.
 func IsNotFound(err error) bool {
-	apiError, ok := err.(*ApiError)
+	apiError, ok := errors.Cause(err).(*ApiError)
 	if !ok {
 		return false
 	}
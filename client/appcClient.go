@@ -53,7 +53,7 @@ func setupGenericBaseClient(rancherClient *GenericBaseClientImpl, opts *ClientOp
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return newApiError(resp, opts.Url)
+		return NewApiError(resp, opts.Url)
 	}
 
 	schemasUrls := resp.Header.Get("X-API-Schemas")
@@ -76,7 +76,7 @@ func setupGenericBaseClient(rancherClient *GenericBaseClientImpl, opts *ClientOp
 		defer resp.Body.Close()
 
 		if resp.StatusCode != 200 {
-			return newApiError(resp, opts.Url)
+			return NewApiError(resp, opts.Url)
 		}
 	}
 
@@ -58,6 +58,8 @@ type Publish struct {
 	Transitioning string `json:"transitioning,omitempty" yaml:"transitioning,omitempty"`
 
 	TransitioningMessage string `json:"transitioningMessage,omitempty" yaml:"transitioning_message,omitempty"`
+
+	TransitioningProgress *int `json:"transitioningProgress,omitempty" yaml:"transitioning_progress,omitempty"`
 }
 
 type PublishCollection struct {
@@ -61,7 +61,7 @@ func (apiClient *GenericBaseClientImpl) doDelete(url string) error {
 	io.Copy(ioutil.Discard, resp.Body)
 
 	if resp.StatusCode >= 300 {
-		return newApiError(resp, url)
+		return NewApiError(resp, url)
 	}
 
 	return nil
@@ -100,7 +100,7 @@ func (apiClient *GenericBaseClientImpl) doGet(url string, opts *ListOpts, respOb
 	defer resp.Body.Close()
 
 	if resp.StatusCode != 200 {
-		return newApiError(resp, url)
+		return NewApiError(resp, url)
 	}
 
 	byteContent, err := ioutil.ReadAll(resp.Body)
@@ -186,7 +186,7 @@ func (apiClient *GenericBaseClientImpl) doModify(method string, url string, crea
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
-		return newApiError(resp, url)
+		return NewApiError(resp, url)
 	}
 
 	byteContent, err := ioutil.ReadAll(resp.Body)
@@ -381,7 +381,7 @@ func (apiClient *GenericBaseClientImpl) doAction(schemaType string, action strin
 	defer resp.Body.Close()
 
 	if resp.StatusCode >= 300 {
-		return newApiError(resp, actionUrl)
+		return NewApiError(resp, actionUrl)
 	}
 
 	byteContent, err := ioutil.ReadAll(resp.Body)
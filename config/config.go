@@ -0,0 +1,501 @@
+// Package config describes a subscriber in a file: how it connects, how it
+// runs handlers and which handler each event goes to.
+//
+// Files are JSON, or YAML if their name ends in .yaml or .yml. Both use the same keys.
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+	"github.com/chenleji/event-subscriber/events"
+	"github.com/chenleji/event-subscriber/handlers"
+	"github.com/chenleji/event-subscriber/journal"
+	"gopkg.in/yaml.v2"
+)
+
+// Handler kinds a route can use.
+const (
+	KindDrop    = "drop"
+	KindLog     = "log"
+	KindExec    = "exec"
+	KindWebhook = "webhook"
+)
+
+// Worker pool types.
+const (
+	PoolSkipping    = "skipping"
+	PoolNonSkipping = "nonSkipping"
+	PoolQueueing    = "queueing"
+)
+
+// Lockers.
+const (
+	LockerResourceID = "resourceId"
+	LockerOrdered    = "ordered"
+	LockerNone       = "none"
+)
+
+var overflowPolicies = map[string]events.OverflowPolicy{
+	"dropNewest":     events.DropNewest,
+	"dropOldest":     events.DropOldest,
+	"replyWithError": events.ReplyWithError,
+}
+
+type Config struct {
+	API     API     `json:"api"`
+	Workers Workers `json:"workers"`
+	// Locker is resourceId, which drops events for a resource that is being handled, ordered,
+	// which queues them, or none. The default is none for a nonSkipping pool, which can't lock
+	// resources, and resourceId otherwise.
+	Locker string             `json:"locker"`
+	Ping   *events.PingConfig `json:"ping"`
+	// Routes map event names or patterns to handlers. Routes with the same Event go to every
+	// handler, one after the other, and fail if any of them fails. Routes with different Events
+	// don't combine: an event takes only the most precise one that matches it.
+	Routes  []Route `json:"routes"`
+	Journal Journal `json:"journal"`
+}
+
+// API says how to connect to Cattle. Empty values are taken from CATTLE_URL,
+// CATTLE_ACCESS_KEY and CATTLE_SECRET_KEY.
+type API struct {
+	URL       string `json:"url"`
+	AccessKey string `json:"accessKey"`
+	SecretKey string `json:"secretKey"`
+}
+
+type Workers struct {
+	// Pool is skipping, which drops events when every worker is busy, nonSkipping, which waits
+	// for a worker, or queueing. The default is skipping.
+	Pool      string `json:"pool"`
+	Size      int    `json:"size"`
+	QueueSize int    `json:"queueSize"`
+	// Overflow is what a queueing pool does when its queue is full: dropNewest, dropOldest,
+	// replyWithError or block. The default is dropNewest.
+	Overflow           string `json:"overflow"`
+	BlockTimeoutMillis int    `json:"blockTimeoutMillis"`
+}
+
+// Journal says where received events and their outcomes are recorded, and how the file rotates.
+type Journal struct {
+	// Path is the file to record to. Empty records nothing.
+	Path string `json:"path"`
+	// MaxSizeMB rotates the file before it grows beyond this many megabytes; 0 is no limit. The
+	// default is DefaultJournalMaxSizeMB.
+	MaxSizeMB int `json:"maxSizeMB"`
+	// MaxAgeMillis rotates the file once it has been written to for this long; 0 is no limit.
+	MaxAgeMillis int `json:"maxAgeMillis"`
+	// MaxBackups is how many rotated files are kept; 0 keeps them all. The default is
+	// DefaultJournalMaxBackups.
+	MaxBackups int `json:"maxBackups"`
+	// RedactKeys are the keys of event data whose values are not recorded. If unset,
+	// journal.DefaultRedactKeys are used.
+	RedactKeys []string `json:"redactKeys"`
+}
+
+// Defaults for the journal's rotation.
+const (
+	DefaultJournalMaxSizeMB  = 100
+	DefaultJournalMaxBackups = 10
+)
+
+type Route struct {
+	// Event is an event name or a pattern such as "instance.*".
+	Event string `json:"event"`
+	// Handler is one of drop, log, exec and webhook.
+	Handler string `json:"handler"`
+	// TimeoutMillis overrides the timeout of the event. Routes for the same event must not set
+	// different timeouts.
+	TimeoutMillis int           `json:"timeoutMillis"`
+	Exec          *ExecRoute    `json:"exec"`
+	Webhook       *WebhookRoute `json:"webhook"`
+}
+
+type ExecRoute struct {
+	Command         string   `json:"command"`
+	Args            []string `json:"args"`
+	Env             []string `json:"env"`
+	Dir             string   `json:"dir"`
+	TimeoutMillis   int      `json:"timeoutMillis"`
+	MaxConcurrent   int      `json:"maxConcurrent"`
+	StderrTailBytes int      `json:"stderrTailBytes"`
+	MaxStdoutBytes  int      `json:"maxStdoutBytes"`
+}
+
+type WebhookRoute struct {
+	URL             string            `json:"url"`
+	Secret          string            `json:"secret"`
+	SignatureHeader string            `json:"signatureHeader"`
+	Headers         map[string]string `json:"headers"`
+	TimeoutMillis   int               `json:"timeoutMillis"`
+	MaxAttempts     int               `json:"maxAttempts"`
+}
+
+// Default returns the configuration the subscriber runs with when there is no file.
+func Default() *Config {
+	return &Config{
+		Workers: Workers{Pool: PoolSkipping, Size: 10},
+		Journal: Journal{MaxSizeMB: DefaultJournalMaxSizeMB, MaxBackups: DefaultJournalMaxBackups},
+	}
+}
+
+// Load reads and validates the file at path. Settings the file leaves out keep their defaults.
+func Load(path string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch filepath.Ext(path) {
+	case ".yaml", ".yml":
+		if data, err = yamlToJSON(data); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+
+	config := Default()
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(config); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	if err := config.Validate(); err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return config, nil
+}
+
+// yamlToJSON converts a YAML document to JSON, so that it is decoded with the same keys and
+// checks as a JSON file.
+func yamlToJSON(data []byte) ([]byte, error) {
+	var document interface{}
+	if err := yaml.Unmarshal(data, &document); err != nil {
+		return nil, err
+	}
+	document, err := jsonValue(document)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(document)
+}
+
+// jsonValue replaces the maps yaml decodes to, which may have keys of any type, with maps that
+// encoding/json can encode.
+func jsonValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[interface{}]interface{}:
+		object := map[string]interface{}{}
+		for key, inner := range v {
+			name, ok := key.(string)
+			if !ok {
+				return nil, fmt.Errorf("key %v is not a string", key)
+			}
+			converted, err := jsonValue(inner)
+			if err != nil {
+				return nil, err
+			}
+			object[name] = converted
+		}
+		return object, nil
+	case []interface{}:
+		for i, inner := range v {
+			converted, err := jsonValue(inner)
+			if err != nil {
+				return nil, err
+			}
+			v[i] = converted
+		}
+	}
+	return value, nil
+}
+
+// Validate checks the configuration without connecting to Cattle.
+func (c *Config) Validate() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	switch c.Workers.Pool {
+	case PoolSkipping, PoolNonSkipping:
+	case PoolQueueing:
+		if c.Workers.QueueSize <= 0 {
+			add("workers.queueSize must be positive for a queueing pool")
+		}
+		if _, ok := overflowPolicies[c.Workers.Overflow]; !ok && c.Workers.Overflow != "" && c.Workers.Overflow != "block" {
+			add("workers.overflow %q is not one of dropNewest, dropOldest, replyWithError and block", c.Workers.Overflow)
+		}
+		if c.Workers.Overflow == "block" && c.Workers.BlockTimeoutMillis <= 0 {
+			add("workers.blockTimeoutMillis must be positive when overflow is block")
+		}
+	default:
+		add("workers.pool %q is not one of %s, %s and %s", c.Workers.Pool, PoolSkipping, PoolNonSkipping, PoolQueueing)
+	}
+	if c.Workers.Size <= 0 {
+		add("workers.size must be positive")
+	}
+
+	switch c.Locker {
+	case "", LockerNone:
+	case LockerResourceID, LockerOrdered:
+		if c.Workers.Pool == PoolNonSkipping {
+			add("locker %s can't be used with a nonSkipping pool, which does not lock resources", c.Locker)
+		}
+	default:
+		add("locker %q is not one of %s, %s and %s", c.Locker, LockerResourceID, LockerOrdered, LockerNone)
+	}
+
+	if c.Ping != nil && (c.Ping.SendPingInterval <= 0 || c.Ping.CheckPongInterval <= 0 || c.Ping.MaxPongWait <= 0) {
+		add("ping intervals must be positive")
+	}
+
+	if c.Journal.MaxSizeMB < 0 || c.Journal.MaxAgeMillis < 0 || c.Journal.MaxBackups < 0 {
+		add("journal limits must not be negative")
+	}
+
+	timeouts := map[string]int{}
+	// limits are the maxConcurrent of each command line, which its routes share.
+	limits := map[string]int{}
+	for i, route := range c.Routes {
+		where := fmt.Sprintf("routes[%d]", i)
+		if route.Event == "" {
+			add("%s: event is required", where)
+		} else {
+			where = fmt.Sprintf("%s (%s)", where, route.Event)
+		}
+		if route.TimeoutMillis > 0 {
+			if timeout, ok := timeouts[route.Event]; ok && timeout != route.TimeoutMillis {
+				add("%s: timeoutMillis %d conflicts with %d set by another route for the same event", where, route.TimeoutMillis, timeout)
+			}
+			timeouts[route.Event] = route.TimeoutMillis
+		}
+		switch route.Handler {
+		case KindDrop, KindLog:
+		case KindExec:
+			if route.Exec == nil || route.Exec.Command == "" {
+				add("%s: exec.command is required for an exec handler", where)
+			} else if route.Exec.MaxConcurrent > 0 {
+				command := handlers.CommandLine(route.Exec.Command, route.Exec.Args)
+				if limit, ok := limits[command]; ok && limit != route.Exec.MaxConcurrent {
+					add("%s: exec.maxConcurrent %d conflicts with %d set by another route running %s", where, route.Exec.MaxConcurrent, limit, strings.Join(append([]string{route.Exec.Command}, route.Exec.Args...), " "))
+				}
+				limits[command] = route.Exec.MaxConcurrent
+			}
+		case KindWebhook:
+			if route.Webhook == nil || route.Webhook.URL == "" {
+				add("%s: webhook.url is required for a webhook handler", where)
+			}
+		default:
+			add("%s: handler %q is not one of %s, %s, %s and %s", where, route.Handler, KindDrop, KindLog, KindExec, KindWebhook)
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// ClientOpts returns the options to connect to Cattle with.
+func (c *Config) ClientOpts() *client.ClientOpts {
+	opts := &client.ClientOpts{
+		Url:       c.API.URL,
+		SecretID:  c.API.AccessKey,
+		SecretKey: c.API.SecretKey,
+	}
+	if opts.Url == "" {
+		opts.Url = os.Getenv("CATTLE_URL")
+	}
+	if opts.SecretID == "" {
+		opts.SecretID = os.Getenv("CATTLE_ACCESS_KEY")
+	}
+	if opts.SecretKey == "" {
+		opts.SecretKey = os.Getenv("CATTLE_SECRET_KEY")
+	}
+	return opts
+}
+
+// JournalConfig returns the configuration of the journal recorder.
+func (c *Config) JournalConfig() journal.Config {
+	return journal.Config{
+		Path:       c.Journal.Path,
+		MaxSize:    int64(c.Journal.MaxSizeMB) * 1024 * 1024,
+		MaxAge:     time.Duration(c.Journal.MaxAgeMillis) * time.Millisecond,
+		MaxBackups: c.Journal.MaxBackups,
+		RedactKeys: c.Journal.RedactKeys,
+	}
+}
+
+// Handlers returns the handler map for the routes, and the timeouts they override.
+func (c *Config) Handlers() (map[string]events.EventHandler, map[string]time.Duration) {
+	routed := map[string][]events.EventHandler{}
+	timeouts := map[string]time.Duration{}
+	for _, route := range c.Routes {
+		routed[route.Event] = append(routed[route.Event], route.handler())
+		if route.TimeoutMillis > 0 {
+			timeouts[route.Event] = time.Duration(route.TimeoutMillis) * time.Millisecond
+		}
+	}
+
+	eventHandlers := map[string]events.EventHandler{}
+	for event, routeHandlers := range routed {
+		if len(routeHandlers) == 1 {
+			eventHandlers[event] = routeHandlers[0]
+		} else {
+			eventHandlers[event] = events.FanOut(events.Sequential, events.AllMustSucceed, routeHandlers...)
+		}
+	}
+	return eventHandlers, timeouts
+}
+
+// HandlersWith returns Handlers with builtin handlers added for the events no route handles.
+func (c *Config) HandlersWith(builtin map[string]events.EventHandler) (map[string]events.EventHandler, map[string]time.Duration) {
+	eventHandlers, timeouts := c.Handlers()
+	for name, handler := range builtin {
+		if _, ok := eventHandlers[name]; !ok {
+			eventHandlers[name] = handler
+		}
+	}
+	return eventHandlers, timeouts
+}
+
+func (r Route) handler() events.EventHandler {
+	switch r.Handler {
+	case KindLog:
+		return logEvent
+	case KindExec:
+		return handlers.Exec(handlers.ExecConfig{
+			Command:       r.Exec.Command,
+			Args:          r.Exec.Args,
+			Env:           r.Exec.Env,
+			Dir:           r.Exec.Dir,
+			Timeout:       time.Duration(r.Exec.TimeoutMillis) * time.Millisecond,
+			MaxConcurrent: r.Exec.MaxConcurrent,
+			StderrTail:    r.Exec.StderrTailBytes,
+			MaxStdout:     r.Exec.MaxStdoutBytes,
+		})
+	case KindWebhook:
+		config := handlers.WebhookConfig{
+			URL:             r.Webhook.URL,
+			Secret:          r.Webhook.Secret,
+			SignatureHeader: r.Webhook.SignatureHeader,
+			Headers:         r.Webhook.Headers,
+			Timeout:         time.Duration(r.Webhook.TimeoutMillis) * time.Millisecond,
+		}
+		if r.Webhook.MaxAttempts > 1 {
+			config.Retry = events.DefaultRetryPolicy
+			config.Retry.MaxAttempts = r.Webhook.MaxAttempts
+		}
+		return handlers.Webhook(config)
+	default:
+		return events.DropEvent
+	}
+}
+
+func logEvent(event *events.Event, apiClient *client.GenericClient) error {
+	log.WithFields(log.Fields{
+		"eventName":    event.Name,
+		"eventId":      event.ID,
+		"resourceType": event.ResourceType,
+		"resourceId":   event.ResourceID,
+	}).Info("Received event")
+	return nil
+}
+
+// locker returns the Locker, or the default for the pool if it isn't set.
+func (c *Config) locker() string {
+	if c.Locker != "" {
+		return c.Locker
+	}
+	if c.Workers.Pool == PoolNonSkipping {
+		return LockerNone
+	}
+	return LockerResourceID
+}
+
+// WorkerPool returns the worker pool to run the router with.
+func (c *Config) WorkerPool() events.WorkerPool {
+	var locker events.EventLocker
+	switch c.locker() {
+	case LockerResourceID:
+		locker = events.ResourceIDLocker
+	case LockerOrdered:
+		locker = events.OrderedResourceLocker(0, nil)
+	}
+
+	switch c.Workers.Pool {
+	case PoolNonSkipping:
+		return events.NonSkippingWorkerPool(c.Workers.Size)
+	case PoolQueueing:
+		overflow, ok := overflowPolicies[c.Workers.Overflow]
+		if c.Workers.Overflow == "block" {
+			overflow = events.BlockWithTimeout(time.Duration(c.Workers.BlockTimeoutMillis) * time.Millisecond)
+		} else if !ok {
+			overflow = events.DropNewest
+		}
+		return events.QueueingWorkerPool(c.Workers.Size, c.Workers.QueueSize, overflow, locker)
+	default:
+		return events.SkippingWorkerPool(c.Workers.Size, locker)
+	}
+}
+
+// NewRouter connects to Cattle and returns a router for the configuration. It checks that the
+// server lets the client subscribe to events and that every route pattern matches an event the
+// server knows of. builtin handlers are added for the events no route handles.
+func (c *Config) NewRouter(builtin map[string]events.EventHandler) (*events.EventRouter, error) {
+	opts := c.ClientOpts()
+	if opts.Url == "" {
+		return nil, fmt.Errorf("No Cattle URL: set api.url or CATTLE_URL")
+	}
+	apiClient, err := client.NewAppCClient(opts)
+	if err != nil {
+		return nil, fmt.Errorf("Connecting to %s: %v", opts.Url, err)
+	}
+	if _, ok := apiClient.GetTypes()["subscribe"]; !ok {
+		return nil, fmt.Errorf("%s has no subscribe schema: the API key is not allowed to subscribe to events", opts.Url)
+	}
+
+	eventHandlers, timeouts := c.HandlersWith(builtin)
+	router, err := events.NewEventRouter(apiClient, c.Workers.Size, eventHandlers)
+	if err != nil {
+		return nil, err
+	}
+	router.HandlerTimeouts = timeouts
+	if c.Ping != nil {
+		router.PingConfig = *c.Ping
+	}
+
+	if err := checkRoutes(router, eventHandlers, opts.Url); err != nil {
+		return nil, err
+	}
+	return router, nil
+}
+
+// checkRoutes fails if a route pattern handles none of the event names the server knows of,
+// because it matches none, which is most likely a typo, or because more precise routes take
+// every name it matches. Exact names are accepted as they are, since the server sends
+// events that no schema lists, such as ping.
+func checkRoutes(router *events.EventRouter, eventHandlers map[string]events.EventHandler, url string) error {
+	used := map[string]bool{}
+	for _, key := range router.Routes() {
+		used[key] = true
+	}
+	var unmatched []string
+	for key := range eventHandlers {
+		if !used[key] {
+			unmatched = append(unmatched, key)
+		}
+	}
+	if len(unmatched) > 0 {
+		sort.Strings(unmatched)
+		return fmt.Errorf("Route patterns handle none of the event names %s knows of, because they match none or more precise routes handle all they match: %s", url, strings.Join(unmatched, ", "))
+	}
+	return nil
+}
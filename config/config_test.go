@@ -0,0 +1,203 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chenleji/event-subscriber/client"
+	"github.com/chenleji/event-subscriber/events"
+)
+
+func writeConfig(t *testing.T, content string) string {
+	return writeConfigNamed(t, "subscriber.json", content)
+}
+
+func writeConfigNamed(t *testing.T, name, content string) string {
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoad(t *testing.T) {
+	path := writeConfig(t, `{
+		"api": {"url": "http://cattle:8080/v1"},
+		"workers": {"pool": "queueing", "size": 4, "queueSize": 100, "overflow": "dropOldest"},
+		"ping": {"sendPingInterval": 1000, "checkPongInterval": 1000, "maxPongWait": 3000},
+		"routes": [
+			{"event": "instance.*", "handler": "log"},
+			{"event": "instance.start", "handler": "exec", "exec": {"command": "/bin/true"}, "timeoutMillis": 5000}
+		],
+		"journal": {"path": "/var/log/events.jsonl", "maxBackups": 0, "redactKeys": ["password"]}
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.locker() != LockerResourceID || config.Workers.Size != 4 || config.Ping.MaxPongWait != 3000 {
+		t.Errorf("Unexpected configuration %+v", config)
+	}
+	if opts := config.ClientOpts(); opts.Url != "http://cattle:8080/v1" {
+		t.Errorf("Unexpected URL %v", opts.Url)
+	}
+	if config.WorkerPool() == nil {
+		t.Error("Expected a worker pool")
+	}
+	if journal := config.JournalConfig(); journal.MaxSize != DefaultJournalMaxSizeMB*1024*1024 || journal.MaxBackups != 0 || len(journal.RedactKeys) != 1 {
+		t.Errorf("Expected the default size limit and the file's backups and keys, got %+v", journal)
+	}
+}
+
+func TestLoadYAML(t *testing.T) {
+	path := writeConfigNamed(t, "subscriber.yaml", `
+workers:
+  pool: queueing
+  size: 4
+  queueSize: 100
+routes:
+  - event: instance.start
+    handler: exec
+    exec:
+      command: /bin/true
+      args: [--verbose]
+    timeoutMillis: 5000
+journal:
+  path: /var/log/events.jsonl
+`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Workers.QueueSize != 100 || len(config.Routes) != 1 || config.Routes[0].Exec.Args[0] != "--verbose" || config.Routes[0].TimeoutMillis != 5000 {
+		t.Errorf("Unexpected configuration %+v", config)
+	}
+	if config.Journal.MaxBackups != DefaultJournalMaxBackups {
+		t.Errorf("Expected settings the file leaves out to keep their defaults, got %+v", config.Journal)
+	}
+
+	path = writeConfigNamed(t, "subscriber.yml", "workers: [size: 1")
+	defer os.RemoveAll(filepath.Dir(path))
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("Expected a syntax error naming the file, got %v", err)
+	}
+}
+
+func TestDefaultLocker(t *testing.T) {
+	path := writeConfig(t, `{"workers": {"pool": "nonSkipping"}}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	config, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.locker() != LockerNone {
+		t.Errorf("Expected no locker for a nonSkipping pool, got %v", config.locker())
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	path := writeConfig(t, `{
+		"workers": {"pool": "nonSkipping", "size": 0},
+		"locker": "ordered",
+		"routes": [
+			{"event": "instance.start", "handler": "email"},
+			{"event": "instance.stop", "handler": "exec"},
+			{"handler": "webhook", "webhook": {"url": "http://hooks"}},
+			{"event": "instance.stop", "handler": "log", "timeoutMillis": 1000},
+			{"event": "instance.stop", "handler": "drop", "timeoutMillis": 2000},
+			{"event": "instance.start", "handler": "exec", "exec": {"command": "/bin/on-event", "maxConcurrent": 2}},
+			{"event": "volume.create", "handler": "exec", "exec": {"command": "/bin/on-event", "maxConcurrent": 4}},
+			{"event": "volume.remove", "handler": "exec", "exec": {"command": "/bin/on-event volume", "maxConcurrent": 1}},
+			{"event": "volume.remove", "handler": "exec", "exec": {"command": "/bin/on-event", "args": ["volume"], "maxConcurrent": 3}}
+		]
+	}`)
+	defer os.RemoveAll(filepath.Dir(path))
+
+	_, err := Load(path)
+	if err == nil {
+		t.Fatal("Expected an invalid configuration")
+	}
+	for _, problem := range []string{
+		"workers.size must be positive",
+		"locker ordered can't be used with a nonSkipping pool",
+		`routes[0] (instance.start): handler "email" is not one of drop, log, exec and webhook`,
+		"routes[1] (instance.stop): exec.command is required",
+		"routes[2]: event is required",
+		"routes[4] (instance.stop): timeoutMillis 2000 conflicts with 1000",
+		"routes[6] (volume.create): exec.maxConcurrent 4 conflicts with 2 set by another route running /bin/on-event",
+	} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("Expected %q in %v", problem, err)
+		}
+	}
+	// A command with a space in its path is not the same command line as one with an argument.
+	if strings.Contains(err.Error(), "routes[8]") {
+		t.Errorf("Expected separate command lines not to conflict, got %v", err)
+	}
+
+	path = writeConfig(t, `{"routes": [{"event": "ping", "handler": "drop"}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	if _, err := Load(path); err == nil || !strings.Contains(err.Error(), path) {
+		t.Errorf("Expected a syntax error naming the file, got %v", err)
+	}
+}
+
+func TestHandlers(t *testing.T) {
+	config := Default()
+	config.Routes = []Route{
+		{Event: "instance.start", Handler: KindLog},
+		{Event: "instance.start", Handler: KindExec, TimeoutMillis: 2000, Exec: &ExecRoute{
+			Command: "/bin/sh",
+			Args:    []string{"-c", `echo "{\"started\": \"$RESOURCE_ID\"}"`},
+		}},
+		{Event: "instance.*", Handler: KindDrop},
+	}
+
+	eventHandlers, timeouts := config.Handlers()
+	if len(eventHandlers) != 2 || timeouts["instance.start"] != 2*time.Second {
+		t.Fatalf("Unexpected handlers %v and timeouts %v", eventHandlers, timeouts)
+	}
+	event := &events.Event{Name: "instance.start", ID: "1", ResourceID: "1i1", ReplyTo: "reply.1"}
+	if err := eventHandlers["instance.start"](event, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data := event.Reply().Data; data["started"] != "1i1" {
+		t.Errorf("Unexpected reply data %v", data)
+	}
+}
+
+func TestCheckRoutes(t *testing.T) {
+	config := Default()
+	config.Routes = []Route{
+		{Event: "instance.*", Handler: KindLog},
+		{Event: "volume.*", Handler: KindLog},
+		{Event: "vm.*", Handler: KindLog},
+		{Event: "*.create", Handler: KindLog},
+		{Event: "volume.create", Handler: KindLog},
+		{Event: "ping", Handler: KindDrop},
+	}
+	eventHandlers, _ := config.Handlers()
+	router, err := events.NewEventRouter(&client.GenericClient{}, 1, eventHandlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	router.KnownEventNames = []string{"instance.start", "volume.create", "volume.remove"}
+
+	err = checkRoutes(router, eventHandlers, "http://cattle")
+	if err == nil || !strings.HasSuffix(err.Error(), "handle all they match: *.create, vm.*") {
+		t.Errorf("Expected vm.* and the shadowed *.create to be reported, got %v", err)
+	}
+}
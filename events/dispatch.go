@@ -0,0 +1,45 @@
+package events
+
+import (
+	"time"
+)
+
+// dispatchTable is the resolved set of handlers a running router subscribes to,
+// keyed by the full event name including any handler suffix.
+type dispatchTable struct {
+	handlers   map[string]EventHandler
+	timeouts   map[string]time.Duration
+	eventNames []string
+}
+
+func (router *EventRouter) buildDispatchTable(eventSuffix string) *dispatchTable {
+	table := &dispatchTable{
+		handlers: map[string]EventHandler{},
+		timeouts: map[string]time.Duration{},
+	}
+
+	eventHandlers := router.handlers()
+	if pingHandler, ok := eventHandlers["ping"]; ok {
+		// Ping doesnt need registered in the POST and ping events don't have the handler suffix.
+		//If we start handling other non-suffix events, we might consider improving this.
+		table.handlers["ping"] = pingHandler
+	} else {
+		table.handlers["ping"] = DropEvent
+	}
+
+	wrapped := router.wrapHandlers(eventHandlers)
+	keys := make([]string, 0, len(wrapped))
+	for key := range wrapped {
+		keys = append(keys, key)
+	}
+
+	for event, key := range resolveNames(keys, router.knownEventNames()) {
+		fullEventKey := event + eventSuffix
+		table.eventNames = append(table.eventNames, fullEventKey)
+		table.handlers[fullEventKey] = wrapped[key]
+		if timeout, ok := router.HandlerTimeouts[key]; ok {
+			table.timeouts[fullEventKey] = timeout
+		}
+	}
+	return table
+}
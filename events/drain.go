@@ -0,0 +1,182 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+)
+
+// DefaultDrainTimeout is how long a router waits for running handlers when it shuts down.
+const DefaultDrainTimeout = 30 * time.Second
+
+// DrainError is returned by WorkerPool.Drain when handlers were still running
+// at the deadline.
+type DrainError struct {
+	Pending []*Event
+}
+
+func (e *DrainError) Error() string {
+	ids := make([]string, 0, len(e.Pending))
+	for _, event := range e.Pending {
+		ids = append(ids, event.Name+":"+event.ID)
+	}
+	return fmt.Sprintf("%d event(s) still running after drain deadline: %v", len(e.Pending), ids)
+}
+
+// inFlight tracks the events a worker pool is handling, and those waiting to be requeued to
+// it, so that it can be drained.
+type inFlight struct {
+	mu sync.Mutex
+	wg sync.WaitGroup
+	// events counts how many times each event is held: a parked event is held both by the
+	// worker that received it and until it has run.
+	events   map[*Event]int
+	requeues map[*pendingRequeue]struct{}
+	draining bool
+	// onDrained, if set, is called once nothing is in flight after draining has begun, when no
+	// more events can reach the pool.
+	onDrained   func()
+	drainedOnce sync.Once
+}
+
+type pendingRequeue struct {
+	event     *Event
+	apiClient *client.GenericClient
+	timer     *time.Timer
+}
+
+func newInFlight() *inFlight {
+	return &inFlight{events: map[*Event]int{}, requeues: map[*pendingRequeue]struct{}{}}
+}
+
+// add registers event as running. It returns false once the pool is draining.
+func (f *inFlight) add(event *Event) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.draining {
+		return false
+	}
+	f.events[event]++
+	f.wg.Add(1)
+	return true
+}
+
+// hold is like add for an event the pool has already taken, so it succeeds while draining.
+// A nil inFlight tracks nothing.
+func (f *inFlight) hold(event *Event) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.events[event]++
+	f.wg.Add(1)
+}
+
+func (f *inFlight) done(event *Event) {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	f.events[event]--
+	if f.events[event] <= 0 {
+		delete(f.events, event)
+	}
+	f.mu.Unlock()
+	f.wg.Done()
+}
+
+// requeue calls run after delay, counting the event as in flight until then. If the pool is
+// draining, or starts to before delay has passed, the event gets an error reply instead.
+func (f *inFlight) requeue(event *Event, delay time.Duration, apiClient *client.GenericClient, run func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.draining {
+		go replyDrained(event, apiClient)
+		return
+	}
+	p := &pendingRequeue{event: event, apiClient: apiClient}
+	f.wg.Add(1)
+	p.timer = time.AfterFunc(delay, func() {
+		f.mu.Lock()
+		_, pending := f.requeues[p]
+		delete(f.requeues, p)
+		f.mu.Unlock()
+		if !pending {
+			// Cancelled by drain, which replies and marks it done.
+			return
+		}
+		run()
+		f.wg.Done()
+	})
+	f.requeues[p] = struct{}{}
+}
+
+func (f *inFlight) drain(timeout time.Duration) error {
+	f.mu.Lock()
+	f.draining = true
+	requeues := f.requeues
+	f.requeues = map[*pendingRequeue]struct{}{}
+	f.mu.Unlock()
+
+	for p := range requeues {
+		p.timer.Stop()
+		replyDrained(p.event, p.apiClient)
+		f.wg.Done()
+	}
+
+	finished := make(chan struct{})
+	go func() {
+		f.wg.Wait()
+		if f.onDrained != nil {
+			f.drainedOnce.Do(f.onDrained)
+		}
+		close(finished)
+	}()
+
+	select {
+	case <-finished:
+		return nil
+	case <-time.After(timeout):
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	pending := make([]*Event, 0, len(f.events))
+	for event := range f.events {
+		pending = append(pending, event)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+	return &DrainError{Pending: pending}
+}
+
+func (f *inFlight) count() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.events)
+}
+
+// dropDraining drops an event handed to a draining pool. A requeued event has already been
+// received and acknowledged, so it gets an error reply rather than being left unanswered.
+func dropDraining(event *Event, apiClient *client.GenericClient) {
+	if event.requeues > 0 {
+		replyDrained(event, apiClient)
+		return
+	}
+	log.Warnf("Worker pool is draining, dropping event. event: %v", *event)
+	notifyDropped(event, DropDraining)
+}
+
+func replyDrained(event *Event, apiClient *client.GenericClient) {
+	log.WithFields(log.Fields{
+		"eventName": event.Name,
+		"eventId":   event.ID,
+	}).Warn("Worker pool is draining, replying with an error to requeued event")
+	notifyDropped(event, DropDraining)
+	publishErrorReply(event, apiClient, fmt.Errorf("Worker pool drained before event %s could be requeued", event.Name))
+}
@@ -0,0 +1,108 @@
+package events
+
+import (
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorKind tells the router how to treat a failed handler call.
+type ErrorKind int
+
+const (
+	// ErrorPermanent is published as an error reply and never retried. Plain errors are treated the same way.
+	ErrorPermanent ErrorKind = iota
+	// ErrorRetryable is retried by the Retry middleware and published as an error reply once retries run out.
+	ErrorRetryable
+	// ErrorIgnore means the event isn't for this handler: nothing is published.
+	ErrorIgnore
+	// ErrorRequeue hands the event back to the worker pool after a delay, without replying.
+	ErrorRequeue
+)
+
+// DefaultMaxRequeues is how many times an event may be requeued unless EventRouter.MaxRequeues says otherwise.
+const DefaultMaxRequeues = 10
+
+// HandlerError is an error a handler can return to control what the router does next.
+type HandlerError struct {
+	Kind ErrorKind
+	Err  error
+	// Code and Data, if set, are added to the Data of the error reply.
+	Code string
+	Data map[string]interface{}
+	// Delay is how long to wait before requeueing an ErrorRequeue event.
+	Delay time.Duration
+}
+
+func (e *HandlerError) Error() string {
+	if e.Err == nil {
+		return "handler error"
+	}
+	return e.Err.Error()
+}
+
+// Cause returns the wrapped error, for use with github.com/pkg/errors.
+func (e *HandlerError) Cause() error {
+	return e.Err
+}
+
+// WithCode attaches a machine-readable code and data to the error reply.
+func (e *HandlerError) WithCode(code string, data map[string]interface{}) *HandlerError {
+	e.Code = code
+	e.Data = data
+	return e
+}
+
+// Permanent marks err as not worth retrying.
+func Permanent(err error) *HandlerError {
+	return &HandlerError{Kind: ErrorPermanent, Err: err}
+}
+
+// Retryable marks err as transient.
+func Retryable(err error) *HandlerError {
+	return &HandlerError{Kind: ErrorRetryable, Err: err}
+}
+
+// Ignore tells the router not to reply to the event. reason is only logged.
+func Ignore(reason string) *HandlerError {
+	return &HandlerError{Kind: ErrorIgnore, Err: errors.New(reason)}
+}
+
+// RequeueAfter asks the router to hand the event to the worker pool again after delay.
+func RequeueAfter(delay time.Duration, err error) *HandlerError {
+	return &HandlerError{Kind: ErrorRequeue, Err: err, Delay: delay}
+}
+
+// AsHandlerError finds a *HandlerError in err or the errors it wraps. Errors without one are
+// treated as ErrorPermanent by the router.
+func AsHandlerError(err error) (*HandlerError, bool) {
+	for err != nil {
+		if handlerErr, ok := err.(*HandlerError); ok {
+			return handlerErr, true
+		}
+		cause, ok := err.(interface {
+			Cause() error
+		})
+		if !ok {
+			return nil, false
+		}
+		err = cause.Cause()
+	}
+	return nil, false
+}
+
+// errorReplyData returns the reply Data for a failed handler call, if any.
+func errorReplyData(err error) map[string]interface{} {
+	handlerErr, ok := AsHandlerError(err)
+	if !ok || (handlerErr.Code == "" && handlerErr.Data == nil) {
+		return nil
+	}
+	data := map[string]interface{}{}
+	for k, v := range handlerErr.Data {
+		data[k] = v
+	}
+	if handlerErr.Code != "" {
+		data["errorCode"] = handlerErr.Code
+	}
+	return data
+}
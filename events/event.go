@@ -1,16 +1,161 @@
 package events
 
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Event is an event as Cattle sends it. EventContext keeps every key of the
+// wire "context" field; use ProcessContext for typed access to the usual ones.
 type Event struct {
-	Name                 string                 `json:"name,omitempty"`
-	ID                   string                 `json:"id,omitempty"`
-	PreviousIds          string                 `json:"previousIds,omitempty"`
-	ReplyTo              string                 `json:"replyTo,omitempty"`
-	ResourceID           string                 `json:"resourceId,omitempty"`
-	ResourceType         string                 `json:"resourceType,omitempty"`
-	Transitioning        string                 `json:"transitioning,omitempty"`
-	TransitioningMessage string                 `json:"transitioningMessage,omitempty"`
-	Data                 map[string]interface{} `json:"data,omitempty"`
-	Time                 float64                `json:"time,omitempty"`
+	Name                         string                 `json:"name,omitempty"`
+	ID                           string                 `json:"id,omitempty"`
+	PreviousIDList               StringList             `json:"previousIds,omitempty"`
+	PreviousNames                StringList             `json:"previousNames,omitempty"`
+	Publisher                    string                 `json:"publisher,omitempty"`
+	ReplyTo                      string                 `json:"replyTo,omitempty"`
+	ResourceID                   string                 `json:"resourceId,omitempty"`
+	ResourceType                 string                 `json:"resourceType,omitempty"`
+	Transitioning                string                 `json:"transitioning,omitempty"`
+	TransitioningMessage         string                 `json:"transitioningMessage,omitempty"`
+	TransitioningInternalMessage string                 `json:"transitioningInternalMessage,omitempty"`
+	TransitioningProgress        *int                   `json:"transitioningProgress,omitempty"`
+	EventContext                 map[string]interface{} `json:"context,omitempty"`
+	Data                         map[string]interface{} `json:"data,omitempty"`
+	Time                         float64                `json:"time,omitempty"`
+	TimeoutMillis                int64                  `json:"timeoutMillis,omitempty"`
+	// PreviousIds is the first of PreviousIDList, kept as a string for handlers written
+	// before the whole list was decoded. An event encoded with an empty PreviousIDList
+	// takes it from here.
+	PreviousIds string `json:"-"`
+
+	ctx            context.Context
+	handlerTimeout time.Duration
+	reply          *ReplyEvent
+	progress       *ProgressReporter
+	router         *EventRouter
+	raw            json.RawMessage
+	requeues       int
+}
+
+func (e *Event) UnmarshalJSON(data []byte) error {
+	// plain has Event's fields but not its methods, so decoding it doesn't recurse.
+	type plain Event
+	if err := json.Unmarshal(data, (*plain)(e)); err != nil {
+		return err
+	}
+	e.PreviousIds = ""
+	if len(e.PreviousIDList) > 0 {
+		e.PreviousIds = e.PreviousIDList[0]
+	}
+	return nil
+}
+
+func (e Event) MarshalJSON() ([]byte, error) {
+	type plain Event
+	if len(e.PreviousIDList) == 0 && e.PreviousIds != "" {
+		e.PreviousIDList = StringList{e.PreviousIds}
+	}
+	return json.Marshal(plain(e))
+}
+
+// ProcessContext describes the Cattle process that emitted an event.
+type ProcessContext struct {
+	LogicName       string
+	LogicPath       string
+	PrettyProcess   string
+	PrettyResource  string
+	ProcessID       string
+	ProcessName     string
+	ProcessUUID     string
+	ResourceID      string
+	ResourceType    string
+	TopProcessName  string
+	TopResourceID   string
+	TopResourceType string
+}
+
+// ProcessContext returns the typed form of the event's EventContext.
+func (e *Event) ProcessContext() ProcessContext {
+	get := func(keys ...string) string {
+		for _, key := range keys {
+			if v, ok := e.EventContext[key]; ok && v != nil {
+				return fmt.Sprint(v)
+			}
+		}
+		return ""
+	}
+	return ProcessContext{
+		LogicName:      get("logicName"),
+		LogicPath:      get("logicPath"),
+		PrettyProcess:  get("prettyProcess"),
+		PrettyResource: get("prettyResource"),
+		ProcessID:      get("processId"),
+		ProcessName:    get("processName"),
+		ProcessUUID:    get("processUuid"),
+		// Cattle misspells these two.
+		ResourceID:      get("resourceId", "resouceId"),
+		ResourceType:    get("resourceType", "resouceType"),
+		TopProcessName:  get("topProcessName"),
+		TopResourceID:   get("topResourceId"),
+		TopResourceType: get("topResourceType"),
+	}
+}
+
+// StringList is a list of strings that also decodes from a lone JSON string.
+type StringList []string
+
+func (l *StringList) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		if single == "" {
+			*l = nil
+		} else {
+			*l = StringList{single}
+		}
+		return nil
+	}
+	var list []string
+	if err := json.Unmarshal(data, &list); err != nil {
+		return err
+	}
+	*l = list
+	return nil
+}
+
+// Context returns the event's context. While a handler runs, it carries the
+// deadline from the event's timeoutMillis or the handler's override.
+func (e *Event) Context() context.Context {
+	if e.ctx == nil {
+		return context.Background()
+	}
+	return e.ctx
+}
+
+// Timeout returns how long the handler may run: the handler's override if
+// there is one, otherwise the event's timeoutMillis. Zero means no limit.
+func (e *Event) Timeout() time.Duration {
+	if e.handlerTimeout > 0 {
+		return e.handlerTimeout
+	}
+	return time.Duration(e.TimeoutMillis) * time.Millisecond
+}
+
+// Raw returns the message the event was decoded from, or nil if its source did not keep it.
+func (e *Event) Raw() json.RawMessage {
+	return e.raw
+}
+
+// SetReply records a reply for the router to publish once the handler returns without error.
+func (e *Event) SetReply(reply *ReplyEvent) {
+	e.reply = reply
+}
+
+// Reply returns the reply set by the handler, if any.
+func (e *Event) Reply() *ReplyEvent {
+	return e.reply
 }
 
 type ReplyEvent struct {
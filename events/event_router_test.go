@@ -2,13 +2,21 @@ package events
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"github.com/chenleji/event-subscriber/client"
+	"github.com/pkg/errors"
+	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"os"
+	"reflect"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -45,6 +53,7 @@ func TestWebsocketPingTimeout(t *testing.T) {
 		CheckPongInterval: 500,
 		MaxPongWait:       1000,
 	})
+	router.ReconnectConfig.MaxRetries = 0
 	ready := make(chan bool, 1)
 
 	routerStopped := make(chan bool, 1)
@@ -67,6 +76,384 @@ func TestWebsocketPingTimeout(t *testing.T) {
 
 }
 
+// A connection that never answers pings should be re-dialed until the retry budget runs out.
+func TestReconnectAfterPongTimeout(t *testing.T) {
+	tu.SetPingHandler(func(appData string) error {
+		return nil
+	})
+
+	eventHandlers := map[string]EventHandler{"physicalhost.create": DropEvent}
+	router := newRouter(eventHandlers, 3, t, PingConfig{
+		SendPingInterval:  100,
+		CheckPongInterval: 100,
+		MaxPongWait:       200,
+	})
+	router.ReconnectConfig = ReconnectConfig{
+		InitialInterval: 10,
+		MaxInterval:     50,
+		Multiplier:      2,
+		MaxRetries:      2,
+	}
+
+	routerStopped := make(chan error, 1)
+	go func() {
+		routerStopped <- router.Start(nil)
+	}()
+	defer tu.ResetTestServer()
+
+	select {
+	case err := <-routerStopped:
+		if err == nil {
+			t.Error("Expected an error once the retry budget was exhausted")
+		}
+	case <-time.After(time.Second * 3):
+		router.Stop()
+		t.Fatalf("Router did not give up reconnecting.")
+	}
+
+	if count := tu.SubscriptionCount(); count != 3 {
+		t.Errorf("Expected 3 subscriptions, got %v", count)
+	}
+}
+
+// Cancelling the context should close the connection and report why the router exited.
+func TestRunContextCancel(t *testing.T) {
+	eventHandlers := map[string]EventHandler{"physicalhost.create": DropEvent}
+	router := newRouter(eventHandlers, 3, t, DefaultPingConfig)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	routerStopped := make(chan error, 1)
+	go func() {
+		routerStopped <- router.Run(ctx)
+	}()
+	defer tu.ResetTestServer()
+
+	select {
+	case <-router.Ready():
+	case <-time.After(time.Second):
+		t.Fatalf("Router never became ready.")
+	}
+	cancel()
+
+	select {
+	case err := <-routerStopped:
+		if !IsCancelled(err) {
+			t.Errorf("Expected a cancelled exit error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Router did not stop after its context was cancelled.")
+	}
+}
+
+type malformedObserver struct {
+	NopObserver
+	messages chan string
+}
+
+func (o *malformedObserver) MessageMalformed(message []byte, err error) {
+	o.messages <- string(message)
+}
+
+// Messages that aren't events should still reach observers before being discarded.
+func TestMalformedMessage(t *testing.T) {
+	router := newRouter(map[string]EventHandler{"physicalhost.create": DropEvent}, 1, t, DefaultPingConfig)
+	observer := &malformedObserver{messages: make(chan string, 1)}
+	router.AddObserver(observer)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go router.Run(ctx)
+	defer tu.ResetTestServer()
+	select {
+	case <-router.Ready():
+	case <-time.After(time.Second):
+		t.Fatalf("Router never became ready.")
+	}
+
+	if _, err := http.Post(pushURL, "application/json", strings.NewReader(`{"name": `)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case message := <-observer.messages:
+		if message != `{"name":` {
+			t.Errorf("Unexpected message %q", message)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Malformed message never reached the observer")
+	}
+}
+
+// Readiness should follow the subscription and the worker pool, and liveness the router goroutine.
+func TestHealthHandler(t *testing.T) {
+	release := make(chan bool)
+	started := make(chan bool, 1)
+	eventHandlers := map[string]EventHandler{"physicalhost.create": func(event *Event, apiClient *client.GenericClient) error {
+		started <- true
+		<-release
+		return nil
+	}}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+	health := NewHealthHandler(router)
+
+	check := func(path string) (int, HealthStatus) {
+		req, _ := http.NewRequest("GET", path, nil)
+		rec := httptest.NewRecorder()
+		health.ServeHTTP(rec, req)
+		status := HealthStatus{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &status); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, status
+	}
+	awaitReady := func() {
+		for i := 0; i < 100; i++ {
+			if code, _ := check("/ready"); code == http.StatusOK {
+				return
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		_, status := check("/ready")
+		t.Fatalf("Router never became ready: %v", status.Failures)
+	}
+
+	if code, _ := check("/live"); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected a router that was not started to not be live, got %v", code)
+	}
+
+	routerStopped := make(chan error, 1)
+	go func() {
+		routerStopped <- router.Run(context.Background())
+	}()
+	defer tu.ResetTestServer()
+	awaitReady()
+
+	pre := func(event *Event) {
+		event.Name = "physicalhost.create"
+	}
+	if err := prepAndPostEvent("../testutils/resources/machine_create_event.json", pre); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	if code, status := check("/ready"); code != http.StatusServiceUnavailable || status.Saturation != 1 {
+		t.Errorf("Expected a saturated pool to not be ready, got %v %+v", code, status)
+	}
+	release <- true
+	awaitReady()
+
+	router.Stop()
+	<-routerStopped
+	code, status := check("/live")
+	if code != http.StatusServiceUnavailable || status.Subscribed {
+		t.Errorf("Expected a stopped router to not be live or subscribed, got %v %+v", code, status)
+	}
+}
+
+// Adding and removing handlers on a running router should resubscribe with the new event names.
+func TestAddRemoveHandler(t *testing.T) {
+	eventsReceived := make(chan *Event, 1)
+	eventHandlers := map[string]EventHandler{"physicalhost.create": DropEvent}
+	router := newRouter(eventHandlers, 3, t, DefaultPingConfig)
+
+	routerStopped := make(chan error, 1)
+	go func() {
+		routerStopped <- router.Run(context.Background())
+	}()
+	defer tu.ResetTestServer()
+	<-router.Ready()
+
+	awaitSubscription := func(count int, name string, subscribed bool) {
+		for i := 0; i < 100; i++ {
+			if tu.SubscriptionCount() == count {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if found := tu.SubscriptionCount(); found != count {
+			t.Fatalf("Expected %v subscriptions, got %v", count, found)
+		}
+		found := false
+		for _, eventName := range tu.SubscribedEventNames() {
+			found = found || eventName == name
+		}
+		if found != subscribed {
+			t.Fatalf("Expected subscribed to %v to be %v, got event names %v", name, subscribed, tu.SubscribedEventNames())
+		}
+	}
+
+	err := router.AddHandler("physicalhost.update", func(event *Event, apiClient *client.GenericClient) error {
+		eventsReceived <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	awaitSubscription(2, "physicalhost.update", true)
+
+	pre := func(event *Event) {
+		event.Name = "physicalhost.update"
+	}
+	if err := prepAndPostEvent("../testutils/resources/machine_create_event.json", pre); err != nil {
+		t.Fatal(err)
+	}
+	awaitEvent(eventsReceived, 1000, t)
+
+	if err := router.RemoveHandler("physicalhost.update"); err != nil {
+		t.Fatal(err)
+	}
+	awaitSubscription(3, "physicalhost.update", false)
+	if err := router.RemoveHandler("physicalhost.update"); err == nil {
+		t.Error("Expected an error removing a handler that is not registered")
+	}
+
+	router.Stop()
+	if err := <-routerStopped; !IsCancelled(err) {
+		t.Errorf("Expected a cancelled exit error, got %v", err)
+	}
+}
+
+// ctxSource is an EventSource whose streams end with the context they were connected with.
+type ctxSource struct {
+	events   chan *Event
+	connects int32
+}
+
+func (s *ctxSource) Connect(ctx context.Context, eventNames []string) (EventStream, error) {
+	atomic.AddInt32(&s.connects, 1)
+	return &ctxStream{ctx: ctx, events: s.events, closed: make(chan struct{})}, nil
+}
+
+type ctxStream struct {
+	ctx       context.Context
+	events    <-chan *Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *ctxStream) Next() (*Event, error) {
+	select {
+	case event := <-s.events:
+		return event, nil
+	case <-s.ctx.Done():
+		return nil, s.ctx.Err()
+	case <-s.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+func (s *ctxStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// The subscription a handoff switches to should outlive the connection it replaced.
+func TestHandoffKeepsNewStream(t *testing.T) {
+	router, err := NewEventRouter(&client.GenericClient{}, 3, map[string]EventHandler{"instance.start": DropEvent})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := &ctxSource{events: make(chan *Event)}
+	router.Source = source
+	router.ReconnectConfig.MaxRetries = 0
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	routerStopped := make(chan error, 1)
+	go func() {
+		routerStopped <- router.Run(ctx)
+	}()
+	<-router.Ready()
+
+	eventsReceived := make(chan *Event, 1)
+	err = router.AddHandler("instance.stop", func(event *Event, apiClient *client.GenericClient) error {
+		eventsReceived <- event
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for start := time.Now(); atomic.LoadInt32(&source.connects) < 2 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+
+	select {
+	case source.events <- &Event{Name: "instance.stop", ID: "1"}:
+	case err := <-routerStopped:
+		t.Fatalf("Router stopped after the handoff: %v", err)
+	case <-time.After(time.Second):
+		t.Fatal("Event was never read after the handoff")
+	}
+	awaitEvent(eventsReceived, 1000, t)
+	if connects := atomic.LoadInt32(&source.connects); connects != 2 {
+		t.Errorf("Expected 2 connects, got %v", connects)
+	}
+}
+
+// Events from a source other than the websocket should be locked, handled and replied to the same way.
+func TestChannelSource(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	router, err := NewEventRouter(apiClient, 3, map[string]EventHandler{
+		"instance.start": ReplyingWithData(func(event *Event, apiClient *client.GenericClient) (map[string]interface{}, error) {
+			return map[string]interface{}{"started": event.ResourceID}, nil
+		}),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	source := make(ChannelSource, 2)
+	router.Source = source
+
+	source <- &Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1", ResourceID: "1i1"}
+	source <- &Event{Name: "instance.start", ID: "2", ReplyTo: "reply.2", ResourceID: "1i2"}
+	close(source)
+
+	err = router.Run(context.Background())
+	if exitErr, ok := err.(*ExitError); !ok || exitErr.Reason != ExitEndOfEvents {
+		t.Errorf("Expected the router to stop at the end of events, got %v", err)
+	}
+	if replies := publisher.replies(); len(replies) != 2 {
+		t.Errorf("Expected 2 replies, got %v", len(replies))
+	}
+}
+
+func TestStopBeforeStart(t *testing.T) {
+	router := newRouter(map[string]EventHandler{}, 1, t, DefaultPingConfig)
+	router.Stop()
+	if err := router.Start(nil); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+// Stop should end only the run in progress, and the websocket should be forgotten once closed.
+func TestStartAfterStop(t *testing.T) {
+	router := newRouter(map[string]EventHandler{"physicalhost.create": DropEvent}, 1, t, DefaultPingConfig)
+	defer tu.ResetTestServer()
+	for i := 0; i < 2; i++ {
+		ready := make(chan bool, 1)
+		routerStopped := make(chan error, 1)
+		go func() {
+			routerStopped <- router.Start(ready)
+		}()
+		select {
+		case <-ready:
+		case <-time.After(time.Second):
+			t.Fatalf("Router never became ready on run %v", i+1)
+		}
+		if router.GetWebSocketConn() == nil {
+			t.Errorf("Expected a websocket while running")
+		}
+		router.Stop()
+		if err := <-routerStopped; err != nil {
+			t.Errorf("Unexpected error %v", err)
+		}
+		if router.GetWebSocketConn() != nil {
+			t.Errorf("Expected no websocket once stopped")
+		}
+	}
+}
+
 // Tests the simplest case of successfully receiving, routing, and handling
 // three events.
 func TestSimpleRouting(t *testing.T) {
@@ -210,6 +597,854 @@ func TestWorkerReuse(t *testing.T) {
 	}
 }
 
+// Draining should stop the pool taking work and report handlers that outlive the deadline.
+func TestWorkerPoolDrain(t *testing.T) {
+	started := make(chan *Event, 3)
+	release := make(chan bool)
+	testHandler := func(event *Event, apiClient *client.GenericClient) error {
+		started <- event
+		<-release
+		return nil
+	}
+	eventHandlers := map[string]EventHandler{"physicalhost.create": testHandler}
+
+	wp := SkippingWorkerPool(3, nil)
+	for i := 0; i < 2; i++ {
+		wp.HandleWork(&Event{Name: "physicalhost.create", ID: strconv.Itoa(i)}, eventHandlers, nil)
+		awaitEvent(started, 100, t)
+	}
+
+	err := wp.Drain(50 * time.Millisecond)
+	drainErr, ok := err.(*DrainError)
+	if !ok {
+		t.Fatalf("Expected a DrainError, got %v", err)
+	}
+	if len(drainErr.Pending) != 2 {
+		t.Errorf("Unexpected pending length %v", len(drainErr.Pending))
+	}
+
+	wp.HandleWork(&Event{Name: "physicalhost.create", ID: "2"}, eventHandlers, nil)
+	if e := awaitEvent(started, 20, t); e != nil {
+		t.Errorf("Draining pool accepted event %v", e.ID)
+	}
+
+	close(release)
+	if err := wp.Drain(time.Second); err != nil {
+		t.Errorf("Unexpected drain error %v", err)
+	}
+}
+
+func TestQueueingWorkerPoolOverflow(t *testing.T) {
+	started := make(chan *Event, 4)
+	release := make(chan bool)
+	testHandler := func(event *Event, apiClient *client.GenericClient) error {
+		started <- event
+		<-release
+		return nil
+	}
+	eventHandlers := map[string]EventHandler{"physicalhost.create": testHandler}
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+
+	wp := QueueingWorkerPool(1, 1, DropOldest, nil)
+	wp.HandleWork(&Event{Name: "physicalhost.create", ID: "0"}, eventHandlers, apiClient)
+	awaitEvent(started, 100, t)
+	for i := 1; i < 3; i++ {
+		wp.HandleWork(&Event{Name: "physicalhost.create", ID: strconv.Itoa(i)}, eventHandlers, apiClient)
+	}
+	release <- true
+	if e := awaitEvent(started, 100, t); e == nil || e.ID != "2" {
+		t.Errorf("Expected the oldest queued event to be dropped, got %v", e)
+	}
+	close(release)
+
+	wp = QueueingWorkerPool(1, 1, ReplyWithError, nil)
+	blocking := make(chan bool)
+	eventHandlers = map[string]EventHandler{"physicalhost.create": func(event *Event, apiClient *client.GenericClient) error {
+		started <- event
+		<-blocking
+		return nil
+	}}
+	wp.HandleWork(&Event{Name: "physicalhost.create", ID: "0"}, eventHandlers, apiClient)
+	awaitEvent(started, 100, t)
+	wp.HandleWork(&Event{Name: "physicalhost.create", ID: "1"}, eventHandlers, apiClient)
+	wp.HandleWork(&Event{Name: "physicalhost.create", ID: "2", ReplyTo: "reply.2"}, eventHandlers, apiClient)
+	close(blocking)
+
+	replies := publisher.replies()
+	if len(replies) != 1 || replies[0].Name != "reply.2" || replies[0].Transitioning != "error" {
+		t.Errorf("Expected an error reply for the rejected event, got %v", replies)
+	}
+	if err := wp.Drain(time.Second); err != nil {
+		t.Errorf("Unexpected drain error %v", err)
+	}
+}
+
+// The workers of a drained queueing pool should exit rather than wait on the queue forever.
+func TestQueueingWorkerPoolExits(t *testing.T) {
+	before := runtime.NumGoroutine()
+	for i := 0; i < 5; i++ {
+		wp := QueueingWorkerPool(10, 10, DropNewest, nil)
+		if err := wp.Drain(time.Second); err != nil {
+			t.Errorf("Unexpected drain error %v", err)
+		}
+	}
+	for start := time.Now(); runtime.NumGoroutine() > before+5 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	if after := runtime.NumGoroutine(); after > before+5 {
+		t.Errorf("Expected the workers to exit, went from %v to %v goroutines", before, after)
+	}
+}
+
+// A pool that can't hold any event should report itself saturated rather than NaN.
+func TestSaturationWithoutCapacity(t *testing.T) {
+	for _, wp := range []WorkerPool{
+		SkippingWorkerPool(0, nil),
+		NonSkippingWorkerPool(0),
+		QueueingWorkerPool(0, 0, DropNewest, nil),
+	} {
+		if saturation := wp.(saturationReporter).saturation(); saturation != 1 {
+			t.Errorf("Expected full saturation for %T, got %v", wp, saturation)
+		}
+	}
+}
+
+// Events for a busy resource should be parked and handled in arrival order rather than dropped.
+func TestOrderedResourceLocker(t *testing.T) {
+	handled := make(chan *Event, 4)
+	release := make(chan bool)
+	testHandler := func(event *Event, apiClient *client.GenericClient) error {
+		if event.ID == "0" {
+			<-release
+		}
+		handled <- event
+		return nil
+	}
+	eventHandlers := map[string]EventHandler{"instance.start": testHandler, "instance.stop": testHandler, "instance.restart": testHandler}
+
+	router := newRouter(eventHandlers, 4, t, DefaultPingConfig)
+	dropped := &droppedObserver{reasons: map[string]DropReason{}}
+	router.AddObserver(dropped)
+	wp := SkippingWorkerPool(4, OrderedResourceLocker(2, CollapseSameName))
+	held, parked, contentions := OrderedLocksHeld(), OrderedLocksParked(), OrderedLockContentions()
+	push := func(id, name string) {
+		wp.HandleWork(&Event{Name: name, ID: id, ResourceType: "instance", ResourceID: "1i1", router: router}, eventHandlers, nil)
+		time.Sleep(10 * time.Millisecond)
+	}
+	push("0", "instance.start")
+	push("1", "instance.stop")
+	push("2", "instance.start")
+	// Supersedes 1.
+	push("3", "instance.stop")
+	// The queue is full so this one is dropped.
+	push("4", "instance.restart")
+	if OrderedLocksHeld()-held != 1 || OrderedLocksParked()-parked != 2 || OrderedLockContentions()-contentions != 4 {
+		t.Errorf("Expected 1 lock held, 2 events parked and 4 contentions, got %v, %v and %v",
+			OrderedLocksHeld()-held, OrderedLocksParked()-parked, OrderedLockContentions()-contentions)
+	}
+	close(release)
+
+	order := []string{}
+	for e := awaitEvent(handled, 100, t); e != nil; e = awaitEvent(handled, 100, t) {
+		order = append(order, e.ID)
+	}
+	if strings.Join(order, ",") != "0,2,3" {
+		t.Errorf("Unexpected handling order %v", order)
+	}
+	if reasons := dropped.get(); len(reasons) != 2 || reasons["1"] != DropCollapsed || reasons["4"] != DropLocked {
+		t.Errorf("Expected 1 to be collapsed and 4 dropped, got %v", reasons)
+	}
+	if OrderedLocksHeld() != held || OrderedLocksParked() != parked {
+		t.Errorf("Expected the lock to be released and nothing parked, got %v and %v", OrderedLocksHeld()-held, OrderedLocksParked()-parked)
+	}
+}
+
+// Parked events should count as pending until they have run, not just the event holding the lock.
+func TestDrainWaitsForParkedEvents(t *testing.T) {
+	release := make(chan bool)
+	handled := make(chan *Event, 2)
+	eventHandlers := map[string]EventHandler{"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+		if event.ID == "0" {
+			<-release
+		}
+		handled <- event
+		return nil
+	}}
+
+	wp := SkippingWorkerPool(2, OrderedResourceLocker(0, nil))
+	wp.HandleWork(&Event{Name: "instance.start", ID: "0", ResourceType: "instance", ResourceID: "1i1"}, eventHandlers, nil)
+	time.Sleep(10 * time.Millisecond)
+	wp.HandleWork(&Event{Name: "instance.start", ID: "1", ResourceType: "instance", ResourceID: "1i1"}, eventHandlers, nil)
+	time.Sleep(10 * time.Millisecond)
+
+	err, ok := wp.Drain(20 * time.Millisecond).(*DrainError)
+	if !ok || len(err.Pending) != 2 {
+		t.Fatalf("Expected the running and the parked event to be pending, got %v", err)
+	}
+	close(release)
+	if err := wp.Drain(time.Second); err != nil {
+		t.Errorf("Unexpected drain error %v", err)
+	}
+	if len(handled) != 2 {
+		t.Errorf("Expected both events to be handled once drained, got %v", len(handled))
+	}
+}
+
+// Events parked by an ordered locker take no worker, so they shouldn't make a pool look busy.
+func TestSaturationIgnoresParkedEvents(t *testing.T) {
+	for _, wp := range []WorkerPool{
+		SkippingWorkerPool(4, OrderedResourceLocker(0, nil)),
+		QueueingWorkerPool(2, 2, DropNewest, OrderedResourceLocker(0, nil)),
+	} {
+		release := make(chan bool)
+		eventHandlers := map[string]EventHandler{"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+			<-release
+			return nil
+		}}
+		for i := 0; i < 4; i++ {
+			wp.HandleWork(&Event{Name: "instance.start", ID: strconv.Itoa(i), ResourceType: "instance", ResourceID: "1i1"}, eventHandlers, nil)
+			time.Sleep(5 * time.Millisecond)
+		}
+		if saturation := wp.(saturationReporter).saturation(); saturation != 0.25 {
+			t.Errorf("Expected only the running event to count, got saturation %v for %T", saturation, wp)
+		}
+		close(release)
+		if err := wp.Drain(time.Second); err != nil {
+			t.Errorf("Unexpected drain error %v", err)
+		}
+	}
+}
+
+type droppedObserver struct {
+	NopObserver
+	mu      sync.Mutex
+	reasons map[string]DropReason
+}
+
+func (o *droppedObserver) EventDropped(event *Event, reason DropReason) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.reasons[event.ID] = reason
+}
+
+func (o *droppedObserver) get() map[string]DropReason {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	reasons := map[string]DropReason{}
+	for id, reason := range o.reasons {
+		reasons[id] = reason
+	}
+	return reasons
+}
+
+func TestPanicReply(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	eventHandlers := map[string]EventHandler{
+		"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+			panic("boom")
+		},
+	}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+
+	wp := SkippingWorkerPool(1, nil)
+	wp.HandleWork(&Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1", router: router}, eventHandlers, apiClient)
+	if err := wp.Drain(time.Second); err != nil {
+		t.Fatalf("Worker didn't finish after the panic: %v", err)
+	}
+
+	replies := publisher.replies()
+	if len(replies) == 0 || replies[0].Transitioning != "error" || !strings.Contains(replies[0].TransitioningMessage, "boom") {
+		t.Errorf("Expected an error reply for the panic, got %v", replies)
+	}
+	if panics := router.Stats().Panics; panics != 1 {
+		t.Errorf("Unexpected panic count %v", panics)
+	}
+}
+
+func TestHandlerTimeout(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	returned := make(chan error, 1)
+	eventHandlers := map[string]EventHandler{
+		"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+			<-event.Context().Done()
+			returned <- event.Context().Err()
+			return event.Context().Err()
+		},
+	}
+
+	start := time.Now()
+	doWork(&Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1", TimeoutMillis: 15000, handlerTimeout: 20 * time.Millisecond},
+		eventHandlers, apiClient, nopLocker(nil), nil, nil)
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Handler override wasn't applied, took %v", elapsed)
+	}
+	if err := <-returned; err != context.DeadlineExceeded {
+		t.Errorf("Unexpected context error %v", err)
+	}
+
+	replies := publisher.replies()
+	if len(replies) != 1 || replies[0].Transitioning != "error" || !strings.Contains(replies[0].TransitioningMessage, "Timed out") {
+		t.Errorf("Expected a single timeout reply, got %v", replies)
+	}
+}
+
+// A handler that ignores its context should be abandoned so that its worker and lock are freed.
+func TestHandlerAbandoned(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	stuck := make(chan bool)
+	defer close(stuck)
+	handled := make(chan *Event, 1)
+	eventHandlers := map[string]EventHandler{"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+		if event.ID == "1" {
+			<-stuck
+		}
+		handled <- event
+		return nil
+	}}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+	router.AbandonAfter = 20 * time.Millisecond
+
+	wp := SkippingWorkerPool(1, ResourceIDLocker)
+	wp.HandleWork(&Event{Name: "instance.start", ID: "1", ResourceType: "instance", ResourceID: "1i1", handlerTimeout: 10 * time.Millisecond, router: router}, eventHandlers, apiClient)
+	if err := wp.Drain(time.Second); err != nil {
+		t.Fatalf("Expected the stuck handler to be abandoned, got %v", err)
+	}
+	if abandoned := router.Stats().Abandoned; abandoned != 1 {
+		t.Errorf("Unexpected abandoned count %v", abandoned)
+	}
+
+	wp = SkippingWorkerPool(1, ResourceIDLocker)
+	wp.HandleWork(&Event{Name: "instance.start", ID: "2", ResourceType: "instance", ResourceID: "1i1", router: router}, eventHandlers, apiClient)
+	if e := awaitEvent(handled, 1000, t); e == nil || e.ID != "2" {
+		t.Errorf("Expected the resource lock to be released, got %v", e)
+	}
+}
+
+// Events repeated by a new subscription should be skipped, but only shortly after a handoff.
+func TestRecentIDs(t *testing.T) {
+	recent := newRecentIDs(time.Hour)
+	if recent.duplicate("1") || recent.duplicate("1") {
+		t.Error("Expected repeated IDs to be let through outside of a handoff")
+	}
+	recent.checkFor(time.Hour)
+	if !recent.duplicate("1") || recent.duplicate("2") || recent.duplicate("") || recent.duplicate("") {
+		t.Error("Expected only the ID read before the handoff to be a duplicate")
+	}
+	recent.checkFor(0)
+	if recent.duplicate("2") {
+		t.Error("Expected duplicates to be let through once the handoff window has passed")
+	}
+}
+
+// Decoding and re-encoding an event shouldn't lose any of its non-null fields.
+func TestEventRoundTrip(t *testing.T) {
+	rawEvent, err := ioutil.ReadFile("../testutils/resources/machine_create_event.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	event := &Event{}
+	if err := json.Unmarshal(rawEvent, event); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := json.Marshal(event)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	original := map[string]interface{}{}
+	roundTripped := map[string]interface{}{}
+	json.Unmarshal(rawEvent, &original)
+	json.Unmarshal(encoded, &roundTripped)
+	for key, value := range original {
+		if value == nil {
+			continue
+		}
+		if !reflect.DeepEqual(value, roundTripped[key]) {
+			t.Errorf("Field %v changed from %v to %v", key, value, roundTripped[key])
+		}
+	}
+
+	pc := event.ProcessContext()
+	if pc.ProcessName != "physicalhost.activate" || pc.ResourceType != "physicalHost" || pc.TopResourceID != "1" {
+		t.Errorf("Unexpected process context %+v", pc)
+	}
+
+	listed := &Event{}
+	if err := json.Unmarshal([]byte(`{"previousIds":["abc","def"]}`), listed); err != nil || len(listed.PreviousIDList) != 2 || listed.PreviousIds != "abc" {
+		t.Errorf("Expected PreviousIds to hold the first previous id, got %q of %v %v", listed.PreviousIds, listed.PreviousIDList, err)
+	}
+
+	legacy := &Event{}
+	if err := json.Unmarshal([]byte(`{"previousIds":"abc"}`), legacy); err != nil || legacy.PreviousIds != "abc" {
+		t.Errorf("Expected a lone previous id to decode, got %v %v", legacy.PreviousIDList, err)
+	}
+	encoded, err = json.Marshal(&Event{PreviousIds: "abc"})
+	if err != nil || !strings.Contains(string(encoded), `"previousIds":["abc"]`) {
+		t.Errorf("Expected PreviousIds to be encoded when the list is empty, got %s %v", encoded, err)
+	}
+}
+
+func TestRetry(t *testing.T) {
+	attempts := 0
+	failures := 2
+	flaky := func(event *Event, apiClient *client.GenericClient) error {
+		attempts++
+		if attempts <= failures {
+			return &client.ApiError{StatusCode: 503, Msg: "unavailable"}
+		}
+		return nil
+	}
+	policy := RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2}
+	handler := Retry(policy)(flaky)
+
+	if err := handler(&Event{Name: "instance.start"}, nil); err != nil || attempts != 3 {
+		t.Errorf("Expected success on the third attempt, got %v after %v attempts", err, attempts)
+	}
+
+	attempts, failures = 0, 5
+	if err := handler(&Event{Name: "instance.start"}, nil); err == nil || attempts != 3 {
+		t.Errorf("Expected failure after 3 attempts, got %v after %v attempts", err, attempts)
+	}
+
+	attempts, failures = 0, 1
+	wrapped := Retry(policy)(func(event *Event, apiClient *client.GenericClient) error {
+		if err := flaky(event, apiClient); err != nil {
+			return errors.Wrap(err, "starting instance")
+		}
+		return nil
+	})
+	if err := wrapped(&Event{Name: "instance.start"}, nil); err != nil || attempts != 2 {
+		t.Errorf("Expected a wrapped server error to be retried, got %v after %v attempts", err, attempts)
+	}
+
+	attempts = 0
+	permanent := Retry(policy)(func(event *Event, apiClient *client.GenericClient) error {
+		attempts++
+		return &client.ApiError{StatusCode: 422, Msg: "invalid"}
+	})
+	if err := permanent(&Event{Name: "instance.start"}, nil); err == nil || attempts != 1 {
+		t.Errorf("Expected a client error not to be retried, got %v attempts", attempts)
+	}
+}
+
+func TestHandlerErrorKinds(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	calls := 0
+	handled := make(chan *Event, 1)
+	eventHandlers := map[string]EventHandler{
+		"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+			return Ignore("not my instance")
+		},
+		"instance.stop": func(event *Event, apiClient *client.GenericClient) error {
+			calls++
+			if calls == 1 {
+				return RequeueAfter(10*time.Millisecond, errors.New("not yet"))
+			}
+			handled <- event
+			return nil
+		},
+		"instance.remove": func(event *Event, apiClient *client.GenericClient) error {
+			return Permanent(errors.New("gone")).WithCode("NotFound", map[string]interface{}{"id": "1i1"})
+		},
+	}
+
+	doWork(&Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}, eventHandlers, apiClient, nopLocker(nil), nil, nil)
+	if replies := publisher.replies(); len(replies) != 0 {
+		t.Errorf("Expected an ignored event not to be replied to, got %v", replies)
+	}
+
+	wp := SkippingWorkerPool(1, nil)
+	wp.HandleWork(&Event{Name: "instance.stop", ID: "2", ReplyTo: "reply.2"}, eventHandlers, apiClient)
+	awaitEvent(handled, 1000, t)
+	if err := wp.Drain(time.Second); err != nil || calls != 2 {
+		t.Errorf("Expected the event to be requeued and handled again, got %v calls", calls)
+	}
+
+	doWork(&Event{Name: "instance.remove", ID: "3", ReplyTo: "reply.3"}, eventHandlers, apiClient, nopLocker(nil), nil, nil)
+	replies := publisher.replies()
+	if len(replies) != 1 || replies[0].Data["errorCode"] != "NotFound" || replies[0].Data["id"] != "1i1" {
+		t.Errorf("Expected an error reply with a code, got %v", replies)
+	}
+}
+
+// Requeues count as in flight, are cut short by Drain and can't go on forever.
+func TestRequeueLimits(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	var calls int32
+	eventHandlers := map[string]EventHandler{
+		"instance.stop": func(event *Event, apiClient *client.GenericClient) error {
+			atomic.AddInt32(&calls, 1)
+			return RequeueAfter(time.Millisecond, errors.New("not yet"))
+		},
+		"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+			return RequeueAfter(time.Hour, errors.New("much later"))
+		},
+	}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+	router.MaxRequeues = 2
+
+	wp := SkippingWorkerPool(1, nil)
+	wp.HandleWork(&Event{Name: "instance.stop", ID: "1", ReplyTo: "reply.1", router: router}, eventHandlers, apiClient)
+	for start := time.Now(); len(publisher.replies()) == 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	replies := publisher.replies()
+	if len(replies) != 1 || !strings.Contains(replies[0].TransitioningMessage, "Gave up after 2 requeues") || atomic.LoadInt32(&calls) != 3 {
+		t.Fatalf("Expected an error reply after 2 requeues, got %v after %v calls", replies, calls)
+	}
+
+	wp.HandleWork(&Event{Name: "instance.start", ID: "2", ReplyTo: "reply.2", router: router}, eventHandlers, apiClient)
+	for start := time.Now(); wp.(*skippingWorkerPool).inFlight.count() > 0 && time.Since(start) < time.Second; {
+		time.Sleep(time.Millisecond)
+	}
+	start := time.Now()
+	if err := wp.Drain(time.Second); err != nil || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("Expected Drain to cancel the pending requeue, got %v after %v", err, time.Since(start))
+	}
+	replies = publisher.replies()
+	if len(replies) != 2 || replies[1].Name != "reply.2" || !strings.Contains(replies[1].TransitioningMessage, "drained") {
+		t.Errorf("Expected an error reply for the cancelled requeue, got %v", replies)
+	}
+}
+
+// A requeued event that finds no room in the pool must still be answered.
+func TestRequeueWithoutWorkers(t *testing.T) {
+	for _, wp := range []WorkerPool{
+		SkippingWorkerPool(1, nil),
+		QueueingWorkerPool(1, 1, DropNewest, nil),
+	} {
+		publisher := &fakePublisher{}
+		apiClient := &client.GenericClient{Publish: publisher}
+		release := make(chan bool)
+		started := make(chan bool, 2)
+		eventHandlers := map[string]EventHandler{
+			"instance.stop": func(event *Event, apiClient *client.GenericClient) error {
+				return RequeueAfter(20*time.Millisecond, errors.New("not yet"))
+			},
+			"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+				started <- true
+				<-release
+				return nil
+			},
+		}
+		wp.HandleWork(&Event{Name: "instance.stop", ID: "1", ReplyTo: "reply.1"}, eventHandlers, apiClient)
+		time.Sleep(5 * time.Millisecond)
+		// Take every worker, and the queue's only slot, until the requeue comes back.
+		wp.HandleWork(&Event{Name: "instance.start", ID: "2"}, eventHandlers, apiClient)
+		<-started
+		wp.HandleWork(&Event{Name: "instance.start", ID: "3"}, eventHandlers, apiClient)
+
+		for start := time.Now(); len(publisher.replies()) == 0 && time.Since(start) < time.Second; {
+			time.Sleep(time.Millisecond)
+		}
+		replies := publisher.replies()
+		if len(replies) != 1 || replies[0].Name != "reply.1" || replies[0].Transitioning != "error" {
+			t.Errorf("Expected an error reply to the dropped requeue from %T, got %v", wp, replies)
+		}
+		close(release)
+		if err := wp.Drain(time.Second); err != nil {
+			t.Errorf("Unexpected drain error %v", err)
+		}
+	}
+}
+
+func TestProgressReporting(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	eventHandlers := map[string]EventHandler{
+		"physicalhost.create": ReplyingWithData(func(event *Event, apiClient *client.GenericClient) (map[string]interface{}, error) {
+			event.Progress().Report("Creating machine", 10)
+			event.Progress().Report("Provisioning", 50)
+			event.Progress().Report("Installing agent", 90)
+			return map[string]interface{}{}, nil
+		}),
+	}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+	router.ProgressInterval = time.Hour
+
+	doWork(&Event{Name: "physicalhost.create", ID: "1", ReplyTo: "reply.1", router: router}, eventHandlers, apiClient, nopLocker(nil), nil, nil)
+
+	replies := publisher.replies()
+	if len(replies) != 3 {
+		t.Fatalf("Expected two progress updates and a reply, got %v", replies)
+	}
+	if *replies[0].TransitioningProgress != 10 || *replies[1].TransitioningProgress != 90 {
+		t.Errorf("Unexpected progress updates %+v %+v", replies[0], replies[1])
+	}
+	if replies[2].Transitioning != "" {
+		t.Errorf("Expected the final reply last, got %+v", replies[2])
+	}
+}
+
+// A throttled update should go out once the interval has passed, even if the handler is still
+// busy, and a 0% update should still carry its progress.
+func TestProgressFlush(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	flushed := make(chan bool)
+	eventHandlers := map[string]EventHandler{
+		"physicalhost.create": func(event *Event, apiClient *client.GenericClient) error {
+			event.Progress().Report("Starting", 0)
+			event.Progress().Report("Provisioning", 50)
+			for start := time.Now(); len(publisher.replies()) < 2 && time.Since(start) < time.Second; {
+				time.Sleep(time.Millisecond)
+			}
+			flushed <- len(publisher.replies()) == 2
+			return nil
+		},
+	}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+	router.ProgressInterval = 20 * time.Millisecond
+
+	go doWork(&Event{Name: "physicalhost.create", ID: "1", ReplyTo: "reply.1", router: router}, eventHandlers, apiClient, nopLocker(nil), nil, nil)
+	if !<-flushed {
+		t.Fatalf("Expected the throttled update while the handler was running, got %v", publisher.replies())
+	}
+
+	replies := publisher.replies()
+	if *replies[1].TransitioningProgress != 50 {
+		t.Errorf("Unexpected progress update %+v", replies[1])
+	}
+	encoded, _ := json.Marshal(replies[0])
+	if !strings.Contains(string(encoded), `"transitioningProgress":0`) {
+		t.Errorf("Expected the 0%% update to carry its progress, got %s", encoded)
+	}
+}
+
+// A slow API should hold up neither the handler calling Report nor the order updates arrive in.
+func TestProgressSlowPublish(t *testing.T) {
+	release := make(chan bool)
+	publisher := &blockingPublisher{release: release}
+	apiClient := &client.GenericClient{Publish: publisher}
+	reported := make(chan bool)
+	eventHandlers := map[string]EventHandler{
+		"physicalhost.create": ReplyingWithData(func(event *Event, apiClient *client.GenericClient) (map[string]interface{}, error) {
+			for _, percent := range []int{10, 50, 90} {
+				event.Progress().Report("Provisioning", percent)
+				time.Sleep(2 * time.Millisecond)
+			}
+			reported <- true
+			return map[string]interface{}{}, nil
+		}),
+	}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+	router.ProgressInterval = time.Millisecond
+
+	done := make(chan bool)
+	go func() {
+		doWork(&Event{Name: "physicalhost.create", ID: "1", router: router, ReplyTo: "reply.1"}, eventHandlers, apiClient, nopLocker(nil), nil, nil)
+		done <- true
+	}()
+	select {
+	case <-reported:
+	case <-time.After(time.Second):
+		t.Fatal("Expected Report not to wait for the API")
+	}
+	close(release)
+	<-done
+
+	replies := publisher.replies()
+	if len(replies) != 4 {
+		t.Fatalf("Expected three progress updates and a reply, got %v", replies)
+	}
+	for i, percent := range []int{10, 50, 90} {
+		if *replies[i].TransitioningProgress != percent {
+			t.Errorf("Expected update %v at %v%%, got %+v", i, percent, replies[i])
+		}
+	}
+	if replies[3].Transitioning != "" {
+		t.Errorf("Expected the final reply last, got %+v", replies[3])
+	}
+}
+
+func TestResolveHandlerPatterns(t *testing.T) {
+	keys := []string{"instance.start", "instance.*", "*.remove", "*"}
+	knownNames := []string{"instance.start", "instance.stop", "instance.remove", "volume.remove", "host.create"}
+
+	resolved := resolveNames(keys, knownNames)
+	expected := map[string]string{
+		"instance.start":  "instance.start",
+		"instance.stop":   "instance.*",
+		"instance.remove": "instance.*",
+		"volume.remove":   "*.remove",
+		"host.create":     "*",
+	}
+	if len(resolved) != len(expected) {
+		t.Errorf("Unexpected resolved names %v", resolved)
+	}
+	for name, want := range expected {
+		if resolved[name] != want {
+			t.Errorf("Expected %v to be handled by %v, got %v", name, want, resolved[name])
+		}
+	}
+
+	if _, err := NewEventRouter(&client.GenericClient{}, 1, map[string]EventHandler{"instance.[": DropEvent}); err == nil {
+		t.Error("Expected an error for a malformed pattern")
+	}
+}
+
+func TestFanOut(t *testing.T) {
+	var mu sync.Mutex
+	var calls []string
+	handler := func(name string, err error) EventHandler {
+		return ReplyingWithData(func(event *Event, apiClient *client.GenericClient) (map[string]interface{}, error) {
+			mu.Lock()
+			calls = append(calls, name)
+			mu.Unlock()
+			return map[string]interface{}{name: true}, err
+		})
+	}
+	failure := errors.New("failed")
+
+	calls = nil
+	event := &Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+	err := FanOut(Sequential, FirstErrorWins, handler("a", nil), handler("b", failure), handler("c", nil))(event, nil)
+	if err != failure || strings.Join(calls, ",") != "a,b" || event.Reply() != nil {
+		t.Errorf("Expected the first error to stop the handlers, got %v, calls %v", err, calls)
+	}
+
+	calls = nil
+	event = &Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+	err = FanOut(Parallel, AllMustSucceed, handler("a", nil), handler("b", failure), handler("c", failure))(event, nil)
+	if fanOutErr, ok := err.(*FanOutError); !ok || len(fanOutErr.Errors) != 2 || len(calls) != 3 {
+		t.Errorf("Expected every handler to run and two errors, got %v, calls %v", err, calls)
+	}
+
+	calls = nil
+	event = &Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+	err = FanOut(Parallel, MergeData, handler("a", nil), handler("b", failure), handler("c", nil))(event, nil)
+	expected := map[string]interface{}{"a": true, "c": true}
+	if err != nil || event.Reply() == nil || !reflect.DeepEqual(event.Reply().Data, expected) {
+		t.Errorf("Expected the replies of the handlers that succeeded to be merged, got %v, %+v", err, event.Reply())
+	}
+
+	// Retrying or requeueing would run the handlers that succeeded again.
+	for _, aggregation := range []Aggregation{AllMustSucceed, FirstErrorWins} {
+		event = &Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+		err = FanOut(Sequential, aggregation, handler("a", nil), handler("b", RequeueAfter(time.Second, failure)))(event, nil)
+		if handlerErr, ok := AsHandlerError(err); !ok || handlerErr.Kind != ErrorPermanent {
+			t.Errorf("Expected a permanent error once a handler succeeded, got %v", err)
+		}
+	}
+	event = &Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+	err = FanOut(Parallel, AllMustSucceed, handler("a", Retryable(failure)), handler("b", failure))(event, nil)
+	if handlerErr, ok := AsHandlerError(err); !ok || handlerErr.Kind != ErrorRetryable {
+		t.Errorf("Expected a retryable error when no handler succeeded, got %v", err)
+	}
+
+	event = &Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+	err = FanOut(Sequential, AllMustSucceed, handler("a", nil), func(event *Event, apiClient *client.GenericClient) error {
+		return Ignore("not mine")
+	})(event, nil)
+	if err != nil || event.Reply() == nil || !reflect.DeepEqual(event.Reply().Data, map[string]interface{}{"a": true}) {
+		t.Errorf("Expected an ignoring handler to be left out, got %v, %+v", err, event.Reply())
+	}
+}
+
+func TestMiddlewareOrder(t *testing.T) {
+	calls := []string{}
+	record := func(name string) Middleware {
+		return func(next EventHandler) EventHandler {
+			return func(event *Event, apiClient *client.GenericClient) error {
+				calls = append(calls, name)
+				return next(event, apiClient)
+			}
+		}
+	}
+	eventHandlers := map[string]EventHandler{
+		"instance.start": func(event *Event, apiClient *client.GenericClient) error {
+			panic("boom")
+		},
+	}
+	router := newRouter(eventHandlers, 1, t, DefaultPingConfig)
+	router.Use(record("global1"), Recover())
+	router.UseFor("instance.start", record("perEvent"))
+	router.Use(record("global2"))
+
+	handler := router.wrapHandlers(eventHandlers)["instance.start"]
+	if err := handler(&Event{Name: "instance.start"}, nil); err == nil {
+		t.Error("Expected the panic to be returned as an error")
+	}
+	if strings.Join(calls, ",") != "global1,global2,perEvent" {
+		t.Errorf("Unexpected middleware order %v", calls)
+	}
+}
+
+type fakePublisher struct {
+	mu        sync.Mutex
+	published []*client.Publish
+}
+
+func (p *fakePublisher) List(opts *client.ListOpts) (*client.PublishCollection, error) {
+	return &client.PublishCollection{}, nil
+}
+
+func (p *fakePublisher) Create(publish *client.Publish) (*client.Publish, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, publish)
+	return publish, nil
+}
+
+func (p *fakePublisher) Update(existing *client.Publish, updates interface{}) (*client.Publish, error) {
+	return existing, nil
+}
+
+func (p *fakePublisher) ById(id string) (*client.Publish, error) {
+	return nil, nil
+}
+
+func (p *fakePublisher) Delete(publish *client.Publish) error {
+	return nil
+}
+
+// blockingPublisher holds every publish until release is closed.
+type blockingPublisher struct {
+	fakePublisher
+	release chan bool
+}
+
+func (p *blockingPublisher) Create(publish *client.Publish) (*client.Publish, error) {
+	<-p.release
+	return p.fakePublisher.Create(publish)
+}
+
+func (p *fakePublisher) replies() []*client.Publish {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*client.Publish{}, p.published...)
+}
+
+func TestSuccessReply(t *testing.T) {
+	publisher := &fakePublisher{}
+	apiClient := &client.GenericClient{Publish: publisher}
+	testHandler := ReplyingWithData(func(event *Event, apiClient *client.GenericClient) (map[string]interface{}, error) {
+		return map[string]interface{}{"ok": true}, nil
+	})
+	eventHandlers := map[string]EventHandler{"physicalhost.create": testHandler}
+
+	doWork(&Event{Name: "physicalhost.create", ID: "1", ReplyTo: "reply.1"}, eventHandlers, apiClient, nopLocker(nil), nil, nil)
+	doWork(&Event{Name: "physicalhost.create", ID: "2"}, eventHandlers, apiClient, nopLocker(nil), nil, nil)
+
+	replies := publisher.replies()
+	if len(replies) != 1 {
+		t.Fatalf("Unexpected reply count %v", len(replies))
+	}
+	reply := replies[0]
+	if reply.Name != "reply.1" || len(reply.PreviousIds) != 1 || reply.PreviousIds[0] != "1" {
+		t.Errorf("Unexpected reply %+v", reply)
+	}
+	if reply.Data["ok"] != true {
+		t.Errorf("Unexpected reply data %v", reply.Data)
+	}
+}
+
 func awaitEvent(eventsReceived chan *Event, millisToWait int, t *testing.T) *Event {
 	timeout := make(chan bool, 1)
 	timeoutFunc := func() {
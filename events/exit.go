@@ -0,0 +1,49 @@
+package events
+
+import "fmt"
+
+// ExitReason describes why an EventRouter stopped running.
+type ExitReason string
+
+const (
+	ExitCancelled    ExitReason = "cancelled"
+	ExitPongTimeout  ExitReason = "pong timeout"
+	ExitServerClosed ExitReason = "server closed"
+	ExitDialFailure  ExitReason = "dial failure"
+	// ExitEndOfEvents means the EventSource had no more events.
+	ExitEndOfEvents ExitReason = "end of events"
+)
+
+// ExitError is returned by the Run methods of EventRouter. When reconnecting
+// is enabled, the reason is that of the last connection attempt before the
+// retry budget ran out.
+type ExitError struct {
+	Reason ExitReason
+	Err    error
+}
+
+func (e *ExitError) Error() string {
+	if e.Err == nil {
+		return fmt.Sprintf("event router exited: %s", e.Reason)
+	}
+	return fmt.Sprintf("event router exited: %s: %s", e.Reason, e.Err)
+}
+
+// Cause returns the underlying error, for use with github.com/pkg/errors.
+func (e *ExitError) Cause() error {
+	return e.Err
+}
+
+// IsCancelled reports whether err is an *ExitError caused by cancellation or Stop.
+func IsCancelled(err error) bool {
+	exitErr, ok := err.(*ExitError)
+	return ok && exitErr.Reason == ExitCancelled
+}
+
+// legacyExitError preserves the old behavior of returning nil when the router was stopped.
+func legacyExitError(err error) error {
+	if err == nil || IsCancelled(err) {
+		return nil
+	}
+	return err
+}
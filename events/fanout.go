@@ -0,0 +1,202 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+)
+
+// FanOutMode says how FanOut runs its handlers.
+type FanOutMode int
+
+const (
+	// Sequential runs the handlers one after another, in the order given.
+	Sequential FanOutMode = iota
+	// Parallel runs the handlers at the same time.
+	Parallel
+)
+
+// Aggregation says how FanOut turns the results of its handlers into one.
+type Aggregation int
+
+const (
+	// AllMustSucceed runs every handler and fails if any of them failed. Replies are merged.
+	AllMustSucceed Aggregation = iota
+	// FirstErrorWins fails with the first error. Sequential handlers after it are skipped and
+	// the context of parallel ones is cancelled.
+	FirstErrorWins
+	// MergeData runs every handler and merges the replies of those that succeeded. It fails
+	// only if every handler failed; other failures are logged.
+	MergeData
+)
+
+// FanOutError is returned by FanOut under AllMustSucceed and MergeData, listing the errors of
+// the handlers that failed. Its cause is the first of them in the order the handlers were
+// given, so a HandlerError there decides how the router treats the event, unless FanOut made
+// it Permanent.
+type FanOutError struct {
+	Errors []error
+}
+
+func (e *FanOutError) Error() string {
+	msgs := make([]string, 0, len(e.Errors))
+	for _, err := range e.Errors {
+		msgs = append(msgs, err.Error())
+	}
+	return fmt.Sprintf("%d handler(s) failed: %s", len(e.Errors), strings.Join(msgs, "; "))
+}
+
+// Cause returns the first error, for use with github.com/pkg/errors.
+func (e *FanOutError) Cause() error {
+	return e.Errors[0]
+}
+
+// FanOut combines handlers into one EventHandler so that several of them can react to the same
+// event. Each handler gets its own copy of the event, so replies set with SetReply don't clash;
+// the copies share Data, which handlers must not modify. When more than one handler replies,
+// the published reply carries the union of their Data, with later handlers winning on
+// conflicting keys. A handler returning an Ignore error is left out of the result.
+//
+// A Retryable or RequeueAfter error runs the whole FanOut again, so once any handler has
+// succeeded, FanOut fails with a Permanent error instead, keeping the code and data of the
+// original, rather than repeat the side effects of the handlers that succeeded. To retry a
+// single handler, wrap it in Retry before passing it to FanOut.
+func FanOut(mode FanOutMode, aggregation Aggregation, handlers ...EventHandler) EventHandler {
+	return func(event *Event, apiClient *client.GenericClient) error {
+		ctx, cancel := context.WithCancel(event.Context())
+		defer cancel()
+
+		copies := make([]*Event, len(handlers))
+		errs := make([]error, len(handlers))
+		var mu sync.Mutex
+		var firstErr error
+
+		run := func(i int) {
+			copied := *event
+			copied.ctx = ctx
+			copied.reply = nil
+			copies[i] = &copied
+			err := callFanOutHandler(handlers[i], &copied, apiClient)
+			errs[i] = err
+			if err == nil || isIgnore(err) {
+				return
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if firstErr == nil {
+				firstErr = err
+				if aggregation == FirstErrorWins {
+					cancel()
+				}
+			}
+		}
+
+		if mode == Parallel {
+			var wg sync.WaitGroup
+			for i := range handlers {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					run(i)
+				}(i)
+			}
+			wg.Wait()
+		} else {
+			for i := range handlers {
+				if aggregation == FirstErrorWins && firstErr != nil {
+					break
+				}
+				run(i)
+			}
+		}
+
+		var failed, ignored []error
+		succeeded := 0
+		for i, err := range errs {
+			switch {
+			case err == nil:
+				if copies[i] != nil {
+					succeeded++
+				}
+			case isIgnore(err):
+				ignored = append(ignored, err)
+			default:
+				failed = append(failed, err)
+			}
+		}
+
+		switch {
+		case aggregation == FirstErrorWins && firstErr != nil:
+			return settle(firstErr, succeeded)
+		case aggregation == AllMustSucceed && len(failed) > 0:
+			return settle(&FanOutError{Errors: failed}, succeeded)
+		case aggregation == MergeData && len(failed) > 0 && len(failed)+len(ignored) == len(handlers):
+			return &FanOutError{Errors: failed}
+		case len(handlers) > 0 && len(ignored) == len(handlers):
+			return ignored[0]
+		}
+
+		for _, err := range failed {
+			log.WithFields(log.Fields{
+				"eventName": event.Name,
+				"eventId":   event.ID,
+				"err":       err,
+			}).Warn("Handler failed, merging the replies of the others")
+		}
+		event.SetReply(mergeReplies(event, copies, errs))
+		return nil
+	}
+}
+
+// callFanOutHandler recovers panics, which in parallel mode would otherwise escape the
+// handler's goroutine.
+func callFanOutHandler(fn EventHandler, event *Event, apiClient *client.GenericClient) (err error) {
+	defer recoverPanic(event, &err)
+	return fn(event, apiClient)
+}
+
+// settle makes err Permanent if it would retry or requeue the event after some handlers have
+// succeeded.
+func settle(err error, succeeded int) error {
+	if succeeded == 0 {
+		return err
+	}
+	handlerErr, ok := AsHandlerError(err)
+	if !ok || (handlerErr.Kind != ErrorRetryable && handlerErr.Kind != ErrorRequeue) {
+		return err
+	}
+	return Permanent(err).WithCode(handlerErr.Code, handlerErr.Data)
+}
+
+func isIgnore(err error) bool {
+	handlerErr, ok := AsHandlerError(err)
+	return ok && handlerErr.Kind == ErrorIgnore
+}
+
+func mergeReplies(event *Event, copies []*Event, errs []error) *ReplyEvent {
+	var replies []*ReplyEvent
+	for i, copied := range copies {
+		if copied != nil && errs[i] == nil && copied.reply != nil {
+			replies = append(replies, copied.reply)
+		}
+	}
+	switch len(replies) {
+	case 0:
+		return nil
+	case 1:
+		return replies[0]
+	}
+
+	merged := NewReplyEvent(event.ReplyTo, event.ID)
+	merged.Data = map[string]interface{}{}
+	for _, reply := range replies {
+		for key, value := range reply.Data {
+			merged.Data[key] = value
+		}
+	}
+	return merged
+}
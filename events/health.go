@@ -0,0 +1,101 @@
+package events
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultMaxSaturation is the share of worker pool capacity in use above which the router is
+// reported as not ready.
+const DefaultMaxSaturation = 0.9
+
+// HealthStatus describes whether the router is alive and able to take events.
+type HealthStatus struct {
+	Live       bool       `json:"live"`
+	Ready      bool       `json:"ready"`
+	Subscribed bool       `json:"subscribed"`
+	LastPong   *time.Time `json:"lastPong,omitempty"`
+	Saturation float64    `json:"saturation"`
+	Failures   []string   `json:"failures,omitempty"`
+}
+
+// saturationReporter is implemented by worker pools that can say how busy they are, as the
+// share of their capacity in use.
+type saturationReporter interface {
+	saturation() float64
+}
+
+// Health reports whether the router is running, and whether it is ready: subscribed to events,
+// receiving pongs within PingConfig.MaxPongWait and with a worker pool no more than
+// maxSaturation busy.
+func (router *EventRouter) Health(maxSaturation float64) HealthStatus {
+	status := HealthStatus{Live: atomic.LoadInt32(&router.running) == 1}
+	if !status.Live {
+		status.Failures = append(status.Failures, "event router is not running")
+	}
+
+	router.mu.Lock()
+	stream := router.stream
+	wp := router.pool
+	router.mu.Unlock()
+
+	if stream == nil {
+		status.Failures = append(status.Failures, "not subscribed to events")
+	} else {
+		status.Subscribed = true
+	}
+	if ws, ok := stream.(*websocketStream); ok {
+		lastPong := ws.lastPong()
+		status.LastPong = &lastPong
+		maxWait := time.Millisecond * time.Duration(router.PingConfig.MaxPongWait)
+		if since := time.Since(lastPong); since > maxWait {
+			status.Failures = append(status.Failures, fmt.Sprintf("no websocket pong for %v, more than %v", since, maxWait))
+		}
+	}
+
+	if sr, ok := wp.(saturationReporter); ok {
+		status.Saturation = sr.saturation()
+		if status.Saturation > maxSaturation {
+			status.Failures = append(status.Failures, fmt.Sprintf("worker pool saturation %.2f is above %.2f", status.Saturation, maxSaturation))
+		}
+	}
+
+	status.Ready = len(status.Failures) == 0
+	return status
+}
+
+// HealthHandler serves the router's liveness at ".../live" and readiness at ".../ready". It
+// responds 200 when the check passes and 503 otherwise, with the HealthStatus as JSON.
+type HealthHandler struct {
+	Router        *EventRouter
+	MaxSaturation float64
+}
+
+func NewHealthHandler(router *EventRouter) *HealthHandler {
+	return &HealthHandler{Router: router, MaxSaturation: DefaultMaxSaturation}
+}
+
+func (h *HealthHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	status := h.Router.Health(h.MaxSaturation)
+
+	var ok bool
+	switch path.Base(req.URL.Path) {
+	case "live":
+		ok = status.Live
+	case "ready":
+		ok = status.Ready
+	default:
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(status)
+}
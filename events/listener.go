@@ -1,39 +1,78 @@
 package events
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
+	"context"
 	"github.com/chenleji/event-subscriber/client"
 
-	"io/ioutil"
-	"net/http"
-	"net/url"
+	"io"
 	"strings"
 	"time"
 
-	"regexp"
+	"sync"
+	"sync/atomic"
 
 	log "github.com/Sirupsen/logrus"
 	"github.com/gorilla/websocket"
 	"github.com/pkg/errors"
 )
 
-var slashRegex = regexp.MustCompile("[/]{2,}")
-
 // EventHandler Defines the function "interface" that handlers must conform to.
+// Handlers must return once event.Context() is done. A handler still running
+// EventRouter.AbandonAfter past its timeout is abandoned: its goroutine is left
+// running, but its worker and resource lock are given to other events.
 type EventHandler func(*Event, *client.GenericClient) error
 
 type EventRouter struct {
-	apiClient     *client.GenericClient
-	subscribeURL  string
-	eventHandlers map[string]EventHandler
-	workerCount   int
-	eventStream   *websocket.Conn
-	PingConfig    PingConfig
+	apiClient       *client.GenericClient
+	subscribeURL    string
+	eventHandlers   map[string]EventHandler
+	handlersMu      sync.Mutex
+	resubscribe     chan struct{}
+	workerCount     int
+	eventStream     *websocket.Conn
+	stream          EventStream
+	pool            WorkerPool
+	running         int32
+	mu              sync.Mutex
+	stopped         chan struct{}
+	readyOnce       sync.Once
+	ready           chan struct{}
+	PingConfig      PingConfig
+	ReconnectConfig ReconnectConfig
+	// Source is where events come from. If nil, the router subscribes to the Cattle event
+	// websocket of its API client.
+	Source EventSource
+	// DrainTimeout is how long the router waits for running handlers before it returns.
+	DrainTimeout time.Duration
+	// ProgressInterval is the least time between two progress updates for the same event.
+	ProgressInterval time.Duration
+	// HandlerTimeouts overrides the event's timeoutMillis for the handlers registered under the
+	// given keys of the handler map.
+	HandlerTimeouts map[string]time.Duration
+	// AbandonAfter is how long a handler may run past its timeout before it is abandoned. Zero
+	// waits for it forever.
+	AbandonAfter time.Duration
+	// MaxRequeues is how many times an event may be requeued with RequeueAfter before it gets an
+	// error reply instead.
+	MaxRequeues int
+	// KnownEventNames lists the event names that handler patterns are expanded against.
+	// If empty, names are derived from the API schemas.
+	KnownEventNames []string
+
+	middlewares        []Middleware
+	handlerMiddlewares map[string][]Middleware
+	stats              routerStats
+	observers          []Observer
 }
 
+// NewEventRouter returns a router that dispatches events to eventHandlers. Keys of eventHandlers
+// are event names or glob patterns such as "instance.*"; see patterns.go for how patterns are
+// expanded and which handler wins when several match.
 func NewEventRouter(apiClient *client.GenericClient, workerCount int, eventHandlers map[string]EventHandler) (*EventRouter, error) {
+	if err := validatePatterns(eventHandlers); err != nil {
+		return nil, err
+	}
+
 	subscribeURL := ""
 
 	if apiClient.GenericBaseClient != nil {
@@ -49,147 +88,286 @@ func NewEventRouter(apiClient *client.GenericClient, workerCount int, eventHandl
 	}
 
 	return &EventRouter{
-		apiClient:     apiClient,
-		subscribeURL:  subscribeURL,
-		eventHandlers: eventHandlers,
-		workerCount:   workerCount,
-		PingConfig:    DefaultPingConfig,
+		apiClient:        apiClient,
+		subscribeURL:     subscribeURL,
+		eventHandlers:    eventHandlers,
+		workerCount:      workerCount,
+		stopped:          make(chan struct{}),
+		resubscribe:      make(chan struct{}, 1),
+		ready:            make(chan struct{}),
+		PingConfig:       DefaultPingConfig,
+		ReconnectConfig:  DefaultReconnectConfig,
+		DrainTimeout:     DefaultDrainTimeout,
+		ProgressInterval: DefaultProgressInterval,
+		MaxRequeues:      DefaultMaxRequeues,
+		AbandonAfter:     DefaultAbandonAfter,
 	}, nil
 }
 
+// StartHandler runs the router until Stop is called, subscribing to events addressed to the named handler.
+// As before, it can be called again after Stop to subscribe anew.
+// Deprecated: use RunHandler.
 func (router *EventRouter) StartHandler(name string, ready chan<- bool) error {
-	wp := SkippingWorkerPool(router.workerCount, resourceIDLocker)
-	return router.run(wp, ready, ";handler="+name)
+	wp := SkippingWorkerPool(router.workerCount, ResourceIDLocker)
+	return legacyExitError(router.run(context.Background(), wp, ready, ";handler="+name))
 }
 
+// Start runs the router until Stop is called. As before, it can be called again after Stop to
+// subscribe anew.
+// Deprecated: use Run.
 func (router *EventRouter) Start(ready chan<- bool) error {
-	wp := SkippingWorkerPool(router.workerCount, resourceIDLocker)
-	return router.run(wp, ready, "")
+	wp := SkippingWorkerPool(router.workerCount, ResourceIDLocker)
+	return legacyExitError(router.run(context.Background(), wp, ready, ""))
 }
 
+// RunWithWorkerPool runs the router with a custom worker pool until Stop is called.
+// Deprecated: use RunWorkerPool.
 func (router *EventRouter) RunWithWorkerPool(wp WorkerPool) error {
-	return router.run(wp, nil, "")
+	return legacyExitError(router.run(context.Background(), wp, nil, ""))
 }
 
-func (router *EventRouter) run(wp WorkerPool, ready chan<- bool, eventSuffix string) (err error) {
+// Run subscribes to events and dispatches them until ctx is cancelled, Stop is called or the
+// reconnect budget runs out. The returned *ExitError says why the router stopped.
+func (router *EventRouter) Run(ctx context.Context) error {
+	wp := SkippingWorkerPool(router.workerCount, ResourceIDLocker)
+	return router.run(ctx, wp, nil, "")
+}
 
-	log.WithFields(log.Fields{
-		"workerCount": router.workerCount,
-	}).Info("Initializing event router")
+// RunHandler is like Run but subscribes to events addressed to the named handler.
+func (router *EventRouter) RunHandler(ctx context.Context, name string) error {
+	wp := SkippingWorkerPool(router.workerCount, ResourceIDLocker)
+	return router.run(ctx, wp, nil, ";handler="+name)
+}
 
-	handlers := map[string]EventHandler{}
+// RunWorkerPool is like Run but dispatches events to a custom worker pool.
+func (router *EventRouter) RunWorkerPool(ctx context.Context, wp WorkerPool) error {
+	return router.run(ctx, wp, nil, "")
+}
 
-	if pingHandler, ok := router.eventHandlers["ping"]; ok {
-		// Ping doesnt need registered in the POST and ping events don't have the handler suffix.
-		//If we start handling other non-suffix events, we might consider improving this.
-		handlers["ping"] = pingHandler
-	} else {
-		handlers["ping"] = DropEvent
-	}
+// RunHandlerWorkerPool is like RunHandler but dispatches events to a custom worker pool.
+func (router *EventRouter) RunHandlerWorkerPool(ctx context.Context, name string, wp WorkerPool) error {
+	return router.run(ctx, wp, nil, ";handler="+name)
+}
 
-	subscribeParams := url.Values{}
-	for event, handler := range router.eventHandlers {
-		fullEventKey := event + eventSuffix
-		subscribeParams.Add("eventNames", fullEventKey)
-		handlers[fullEventKey] = handler
-	}
+// Ready returns a channel that is closed once the router first subscribes to events.
+func (router *EventRouter) Ready() <-chan struct{} {
+	return router.ready
+}
 
-	accessKey := ""
-	secretKey := ""
-	if router.apiClient.GenericBaseClient != nil {
-		accessKey = router.apiClient.GetOpts().SecretID
-		secretKey = router.apiClient.GetOpts().SecretKey
-	}
+func (router *EventRouter) run(ctx context.Context, wp WorkerPool, ready chan<- bool, eventSuffix string) error {
 
-	eventStream, err := router.subscribeToEvents(router.subscribeURL, accessKey, secretKey, subscribeParams)
-	if err != nil {
-		return err
-	}
-	log.Info("Connection established")
-	router.eventStream = eventStream
-	defer router.Stop()
+	log.WithFields(log.Fields{
+		"workerCount": router.workerCount,
+	}).Info("Initializing event router")
 
-	if ready != nil {
-		ready <- true
-	}
+	router.mu.Lock()
+	router.pool = wp
+	stopped := router.stopped
+	router.mu.Unlock()
+	atomic.StoreInt32(&router.running, 1)
+	defer atomic.StoreInt32(&router.running, 0)
+	// Stop ends only this run; the next one waits for a Stop of its own.
+	defer func() {
+		router.mu.Lock()
+		if router.stopped == stopped {
+			router.stopped = make(chan struct{})
+		}
+		router.mu.Unlock()
+	}()
 
-	ph := newPongHandler(router)
-	defer ph.stop()
-	router.eventStream.SetPongHandler(ph.handle)
-	go router.sendWebsocketPings()
+	defer router.drain(wp)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-stopped:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
 
+	attempt := 0
+	connected := false
+	recent := newRecentIDs(HandoffDedupeWindow)
+	var next *subscription
 	for {
-		_, message, err := router.eventStream.ReadMessage()
+		var exitErr *ExitError
+		var err error
+		sub, handedOff := next, next != nil
+		next = nil
+		if !handedOff {
+			sub, err = router.subscribe(ctx, eventSuffix)
+		}
 		if err != nil {
-			// Error here means the connection is closed. It's normal, so just return.
-			return nil
+			exitErr = &ExitError{Reason: ExitDialFailure, Err: err}
+		} else {
+			log.Info("Connection established")
+			if handedOff {
+				// The old connection was serving events until the new one replaced it.
+				attempt = 0
+				// The new subscription overlapped the old one, so it may repeat some of its events.
+				recent.checkFor(HandoffDedupeWindow)
+			}
+			if connected && !handedOff {
+				router.notify(func(o Observer) {
+					o.Reconnected()
+				})
+			}
+			connected = true
+			router.readyOnce.Do(func() {
+				close(router.ready)
+			})
+			if ready != nil {
+				ready <- true
+				ready = nil
+			}
+
+			connCtx, closeConn := context.WithCancel(ctx)
+			result := make(chan *handoff, 1)
+			go router.watchResubscribe(ctx, connCtx, eventSuffix, closeConn, result)
+			var healthy bool
+			healthy, exitErr = router.readEvents(connCtx, sub.stream, wp, sub.table, recent)
+			closeConn()
+			if h := <-result; h != nil {
+				if h.err != nil {
+					exitErr = &ExitError{Reason: ExitDialFailure, Err: h.err}
+				} else if ctx.Err() != nil {
+					h.sub.stream.Close()
+				} else {
+					// Switch to the new subscription without waiting.
+					next = h.sub
+					continue
+				}
+			}
+			if healthy {
+				attempt = 0
+			}
 		}
 
-		message = bytes.TrimSpace(message)
-		if len(message) == 0 {
-			continue
+		if ctx.Err() != nil {
+			return &ExitError{Reason: ExitCancelled, Err: ctx.Err()}
+		}
+		if exitErr.Reason == ExitEndOfEvents || !router.ReconnectConfig.canRetry(attempt) {
+			return exitErr
 		}
 
-		event := &Event{}
-		err = json.Unmarshal(message, &event)
-		if err != nil {
-			log.WithFields(log.Fields{
-				"message": string(message),
-			}).Warnf("Error parsing message: %s", err)
-			continue
+		wait := router.ReconnectConfig.backoff(attempt)
+		attempt++
+		log.WithFields(log.Fields{
+			"attempt": attempt,
+			"wait":    wait,
+			"reason":  exitErr.Reason,
+		}).Info("Reconnecting to event stream")
+
+		select {
+		case <-ctx.Done():
+			return &ExitError{Reason: ExitCancelled, Err: ctx.Err()}
+		case <-time.After(wait):
 		}
-		wp.HandleWork(event, handlers, router.apiClient)
 	}
 }
 
-func (router *EventRouter) Stop() {
-	router.eventStream.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
-	router.eventStream.Close()
+func (router *EventRouter) source() EventSource {
+	if router.Source != nil {
+		return router.Source
+	}
+	return &websocketSource{router: router}
 }
 
-func (router *EventRouter) subscribeToEvents(subscribeURL string, accessKey string, secretKey string, data url.Values) (*websocket.Conn, error) {
-	// gorilla websocket will blow up if the path starts with //
-	parsed, err := url.Parse(subscribeURL)
-	if err != nil {
-		return nil, err
-	}
-	if strings.HasPrefix(parsed.Path, "//") {
-		parsed.Path = slashRegex.ReplaceAllString(parsed.Path, "/")
-		subscribeURL = parsed.String()
+func (router *EventRouter) drain(wp WorkerPool) {
+	log.WithFields(log.Fields{
+		"timeout": router.DrainTimeout,
+	}).Info("Draining worker pool")
+	if err := wp.Drain(router.DrainTimeout); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Warn("Event router exited with handlers still running")
 	}
+}
 
-	dialer := &websocket.Dialer{
-		HandshakeTimeout: time.Second * 30,
+// readEvents dispatches events from stream until it ends or ctx is cancelled, skipping those
+// recent reports as duplicates. It reports whether the connection was healthy, meaning it
+// delivered at least one event or pong before going away, and why it went away.
+func (router *EventRouter) readEvents(ctx context.Context, stream EventStream, wp WorkerPool, table *dispatchTable, recent *recentIDs) (bool, *ExitError) {
+	router.mu.Lock()
+	router.stream = stream
+	if ws, ok := stream.(*websocketStream); ok {
+		router.eventStream = ws.conn
 	}
-	headers := http.Header{}
-	headers.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(accessKey+":"+secretKey)))
-	subscribeURL = subscribeURL + "?" + data.Encode()
-	ws, resp, err := dialer.Dial(subscribeURL, headers)
+	router.mu.Unlock()
+	defer func() {
+		router.mu.Lock()
+		router.stream = nil
+		router.eventStream = nil
+		router.mu.Unlock()
+	}()
 
-	if err != nil {
-		log.WithFields(log.Fields{
-			"subscribeUrl": subscribeURL,
-		}).Errorf("Error subscribing to events: %s", err)
-		if resp != nil {
-			log.WithFields(log.Fields{
-				"status":          resp.Status,
-				"statusCode":      resp.StatusCode,
-				"responseHeaders": resp.Header,
-			}).Error("Got error response")
-			if resp.Body != nil {
-				defer resp.Body.Close()
-				body, _ := ioutil.ReadAll(resp.Body)
-				log.Errorf("Error response: %s", body)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-done:
+		}
+		stream.Close()
+	}()
+
+	healthy := false
+	for {
+		event, err := stream.Next()
+		if err != nil {
+			if ws, ok := stream.(*websocketStream); ok {
+				healthy = healthy || ws.gotPong()
+			}
+			if exitErr, ok := err.(*ExitError); ok && ctx.Err() == nil {
+				return healthy, exitErr
+			}
+			switch {
+			case ctx.Err() != nil:
+				return healthy, &ExitError{Reason: ExitCancelled, Err: ctx.Err()}
+			case err == io.EOF:
+				return healthy, &ExitError{Reason: ExitEndOfEvents, Err: err}
+			default:
+				return healthy, &ExitError{Reason: ExitServerClosed, Err: err}
 			}
 		}
-		if ws != nil {
-			ws.Close()
+		healthy = true
+		if recent.duplicate(event.ID) {
+			log.WithFields(log.Fields{
+				"eventName": event.Name,
+				"eventId":   event.ID,
+			}).Debug("Skipping event delivered again after resubscribing")
+			continue
 		}
-		return nil, err
+
+		event.router = router
+		event.handlerTimeout = table.timeouts[event.Name]
+		atomic.AddUint64(&router.stats.received, 1)
+		router.notify(func(o Observer) {
+			o.EventReceived(event)
+		})
+		wp.HandleWork(event, table.handlers, router.apiClient)
+	}
+}
+
+// Stop closes the event stream and keeps the router from reconnecting. It is safe to call more
+// than once, and before the router has connected. It ends the current run, or the next one if
+// the router isn't running; the router can be run again once that run has returned.
+func (router *EventRouter) Stop() {
+	router.mu.Lock()
+	defer router.mu.Unlock()
+	select {
+	case <-router.stopped:
+	default:
+		close(router.stopped)
 	}
-	return ws, nil
 }
 
+// GetWebSocketConn returns the websocket the router is reading events from, or nil if it isn't
+// connected to one.
 func (router *EventRouter) GetWebSocketConn() *websocket.Conn {
+	router.mu.Lock()
+	defer router.mu.Unlock()
 	return router.eventStream
 }
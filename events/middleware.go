@@ -0,0 +1,96 @@
+package events
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+)
+
+// Middleware wraps an EventHandler, for example to log, time or recover it.
+type Middleware func(EventHandler) EventHandler
+
+// Chain wraps handler in middlewares. The first middleware is the outermost,
+// so it sees the event first and the result last.
+func Chain(handler EventHandler, middlewares ...Middleware) EventHandler {
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// Use registers middlewares that wrap every handler. Global middlewares run
+// outside those registered with UseFor, in the order they were added. It must
+// be called before the router is started.
+func (router *EventRouter) Use(middlewares ...Middleware) {
+	router.middlewares = append(router.middlewares, middlewares...)
+}
+
+// UseFor registers middlewares that wrap only the handler registered under
+// eventName, which is a key of the handler map and so may be a pattern. It
+// must be called before the router is started.
+func (router *EventRouter) UseFor(eventName string, middlewares ...Middleware) {
+	if router.handlerMiddlewares == nil {
+		router.handlerMiddlewares = map[string][]Middleware{}
+	}
+	router.handlerMiddlewares[eventName] = append(router.handlerMiddlewares[eventName], middlewares...)
+}
+
+func (router *EventRouter) wrapHandlers(eventHandlers map[string]EventHandler) map[string]EventHandler {
+	wrapped := map[string]EventHandler{}
+	for name, handler := range eventHandlers {
+		middlewares := append([]Middleware{}, router.middlewares...)
+		middlewares = append(middlewares, router.handlerMiddlewares[name]...)
+		wrapped[name] = Chain(handler, middlewares...)
+	}
+	return wrapped
+}
+
+// Recover turns a panic in the handler into an error, logging the stack trace.
+func Recover() Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(event *Event, apiClient *client.GenericClient) (err error) {
+			defer recoverPanic(event, &err)
+			return next(event, apiClient)
+		}
+	}
+}
+
+// Logging logs the outcome and duration of every handler call to logger, or
+// to the standard logger if logger is nil.
+func Logging(logger *log.Logger) Middleware {
+	if logger == nil {
+		logger = log.StandardLogger()
+	}
+	return func(next EventHandler) EventHandler {
+		return func(event *Event, apiClient *client.GenericClient) error {
+			start := time.Now()
+			err := next(event, apiClient)
+			entry := logger.WithFields(log.Fields{
+				"eventName":    event.Name,
+				"eventId":      event.ID,
+				"resourceType": event.ResourceType,
+				"resourceId":   event.ResourceID,
+				"duration":     time.Since(start),
+			})
+			if err != nil {
+				entry.WithField("err", err).Warn("Event handler failed")
+			} else {
+				entry.Info("Event handled")
+			}
+			return err
+		}
+	}
+}
+
+// Latency calls observe with the duration and result of every handler call.
+func Latency(observe func(event *Event, duration time.Duration, err error)) Middleware {
+	return func(next EventHandler) EventHandler {
+		return func(event *Event, apiClient *client.GenericClient) error {
+			start := time.Now()
+			err := next(event, apiClient)
+			observe(event, time.Since(start), err)
+			return err
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package events
+
+import (
+	"time"
+)
+
+// DropReason says why an event was not handled.
+type DropReason string
+
+const (
+	DropNoWorker  DropReason = "no_worker"
+	DropQueueFull DropReason = "queue_full"
+	DropLocked    DropReason = "locked"
+	DropDraining  DropReason = "draining"
+	DropNoHandler DropReason = "no_handler"
+	// DropCollapsed is an event parked by an ordered locker that a newer event made obsolete.
+	DropCollapsed DropReason = "collapsed"
+)
+
+// Observer is notified of what the router and its worker pool do with events.
+// Methods are called from the read loop and from workers, so they must be
+// safe for concurrent use and return quickly.
+type Observer interface {
+	EventReceived(event *Event)
+	EventDropped(event *Event, reason DropReason)
+	HandlerStarted(event *Event)
+	HandlerFinished(event *Event, duration time.Duration, err error)
+	// HandlerAbandoned is called when a handler that ignored its timeout is abandoned. It is
+	// called before HandlerFinished, while the handler is still running.
+	HandlerAbandoned(event *Event)
+	PublishFailed(event *Event, err error)
+	Reconnected()
+	PongReceived()
+	// MessageMalformed is called with a message read from the event stream that could not be
+	// parsed as an event, and is otherwise discarded.
+	MessageMalformed(message []byte, err error)
+}
+
+// NopObserver implements Observer by doing nothing. Embed it to implement only some methods.
+type NopObserver struct{}
+
+func (NopObserver) EventReceived(event *Event)                                      {}
+func (NopObserver) EventDropped(event *Event, reason DropReason)                    {}
+func (NopObserver) HandlerStarted(event *Event)                                     {}
+func (NopObserver) HandlerFinished(event *Event, duration time.Duration, err error) {}
+func (NopObserver) HandlerAbandoned(event *Event)                                   {}
+func (NopObserver) PublishFailed(event *Event, err error)                           {}
+func (NopObserver) Reconnected()                                                    {}
+func (NopObserver) PongReceived()                                                   {}
+func (NopObserver) MessageMalformed(message []byte, err error)                      {}
+
+// AddObserver registers an observer. It must be called before the router is started.
+func (router *EventRouter) AddObserver(observer Observer) {
+	router.observers = append(router.observers, observer)
+}
+
+func (router *EventRouter) notify(fn func(Observer)) {
+	for _, observer := range router.observers {
+		fn(observer)
+	}
+}
+
+// notify calls fn for each observer of the router that received event, if any.
+func notify(event *Event, fn func(Observer)) {
+	if event.router != nil {
+		event.router.notify(fn)
+	}
+}
+
+func notifyDropped(event *Event, reason DropReason) {
+	notify(event, func(o Observer) {
+		o.EventDropped(event, reason)
+	})
+}
+
+func notifyPublishFailed(event *Event, err error) {
+	notify(event, func(o Observer) {
+		o.PublishFailed(event, err)
+	})
+}
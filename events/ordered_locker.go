@@ -0,0 +1,184 @@
+package events
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/locks"
+)
+
+// CollapseFunc reports whether a queued event is made obsolete by an incoming
+// event for the same resource, in which case the queued event is discarded.
+type CollapseFunc func(queued, incoming *Event) bool
+
+// CollapseSameName treats a queued event as obsolete when a newer event with the same name arrives.
+func CollapseSameName(queued, incoming *Event) bool {
+	return queued.Name == incoming.Name
+}
+
+// orderedLocker is implemented by lockers that park events for a busy resource rather than refusing them.
+type orderedLocker interface {
+	// lockOrPark returns an Unlocker if the lock was obtained. Otherwise it returns nil and
+	// either parks run, to be called with the lock held once it is released, or drops the
+	// event. A dropped event, or a parked one that is later collapsed, gets discard called
+	// instead of run.
+	lockOrPark(event *Event, run, discard func()) locks.Unlocker
+}
+
+// Counts across every OrderedResourceLocker, as locks counts for KeyLocker.
+var (
+	orderedHeld        int64
+	orderedParked      int64
+	orderedContentions uint64
+)
+
+// OrderedLocksHeld returns the number of resources currently locked through an
+// OrderedResourceLocker.
+func OrderedLocksHeld() int64 {
+	return atomic.LoadInt64(&orderedHeld)
+}
+
+// OrderedLocksParked returns the number of events currently parked by an OrderedResourceLocker.
+func OrderedLocksParked() int64 {
+	return atomic.LoadInt64(&orderedParked)
+}
+
+// OrderedLockContentions returns how many events found their resource locked by an
+// OrderedResourceLocker, whether they were then parked or dropped.
+func OrderedLockContentions() uint64 {
+	return atomic.LoadUint64(&orderedContentions)
+}
+
+type parkedEvent struct {
+	event   *Event
+	run     func()
+	discard func()
+}
+
+type resourceQueues struct {
+	mu sync.Mutex
+	// A key is locked while it is present in queues.
+	queues    map[string][]*parkedEvent
+	maxQueued int
+	collapse  CollapseFunc
+}
+
+// OrderedResourceLocker returns an EventLocker that locks on resource like the
+// default locker. Instead of dropping an event whose resource is being
+// handled, it parks the event in a per-resource FIFO of up to maxQueued
+// events (unbounded if maxQueued <= 0). Parked events are handled in arrival
+// order by the worker holding the lock. If collapse is not nil, queued events
+// it reports obsolete are discarded as new events arrive.
+func OrderedResourceLocker(maxQueued int, collapse CollapseFunc) EventLocker {
+	queues := &resourceQueues{
+		queues:    map[string][]*parkedEvent{},
+		maxQueued: maxQueued,
+		collapse:  collapse,
+	}
+	return func(event *Event) locks.Locker {
+		if event.ResourceID == "" {
+			return locks.NopLocker()
+		}
+		key := fmt.Sprintf("%s:%s", event.ResourceType, event.ResourceID)
+		return &orderedLock{queues: queues, key: key}
+	}
+}
+
+type orderedLock struct {
+	queues *resourceQueues
+	key    string
+}
+
+func (l *orderedLock) Lock() locks.Unlocker {
+	q := l.queues
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, locked := q.queues[l.key]; locked {
+		atomic.AddUint64(&orderedContentions, 1)
+		return nil
+	}
+	q.queues[l.key] = nil
+	atomic.AddInt64(&orderedHeld, 1)
+	return l
+}
+
+func (l *orderedLock) lockOrPark(event *Event, run, discard func()) locks.Unlocker {
+	q := l.queues
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	queued, locked := q.queues[l.key]
+	if !locked {
+		q.queues[l.key] = nil
+		atomic.AddInt64(&orderedHeld, 1)
+		return l
+	}
+	atomic.AddUint64(&orderedContentions, 1)
+
+	if q.collapse != nil {
+		kept := queued[:0]
+		for _, p := range queued {
+			if q.collapse(p.event, event) {
+				log.WithFields(log.Fields{
+					"resourceId":   event.ResourceID,
+					"eventId":      p.event.ID,
+					"supersededBy": event.ID,
+				}).Debug("Collapsing obsolete queued event")
+				atomic.AddInt64(&orderedParked, -1)
+				notifyDropped(p.event, DropCollapsed)
+				p.discard()
+				continue
+			}
+			kept = append(kept, p)
+		}
+		queued = kept
+	}
+
+	if q.maxQueued > 0 && len(queued) >= q.maxQueued {
+		q.queues[l.key] = queued
+		log.WithFields(log.Fields{
+			"resourceId": event.ResourceID,
+			"maxQueued":  q.maxQueued,
+			"event":      *event,
+		}).Warn("Resource queue full. Dropping event")
+		notifyDropped(event, DropLocked)
+		discard()
+		return nil
+	}
+
+	q.queues[l.key] = append(queued, &parkedEvent{event: event, run: run, discard: discard})
+	atomic.AddInt64(&orderedParked, 1)
+	log.WithFields(log.Fields{
+		"resourceId": event.ResourceID,
+		"queued":     len(q.queues[l.key]),
+	}).Debug("Resource locked. Queueing event")
+	return nil
+}
+
+// Unlock runs any events parked for the resource, in order, before releasing the lock.
+func (l *orderedLock) Unlock() {
+	for {
+		next := l.queues.next(l.key)
+		if next == nil {
+			return
+		}
+		next.run()
+	}
+}
+
+// next pops the next parked event for key, releasing the lock on key if there are none.
+func (q *resourceQueues) next(key string) *parkedEvent {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	queued := q.queues[key]
+	if len(queued) == 0 {
+		delete(q.queues, key)
+		atomic.AddInt64(&orderedHeld, -1)
+		return nil
+	}
+	q.queues[key] = queued[1:]
+	atomic.AddInt64(&orderedParked, -1)
+	return queued[0]
+}
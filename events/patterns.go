@@ -0,0 +1,134 @@
+package events
+
+import (
+	"path"
+	"sort"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/pkg/errors"
+)
+
+// Handler map keys may be glob patterns such as "instance.*" or "*.remove",
+// using the syntax of path.Match. Patterns can't be subscribed to directly, so
+// the router expands them against a list of known event names: the router's
+// KnownEventNames if set, otherwise names derived from the API schemas.
+//
+// When more than one key matches an event name, the handler is chosen by:
+//  1. an exact (non-pattern) key,
+//  2. the pattern with the most literal characters, so "instance.*" beats "*",
+//  3. the lexically smallest pattern, to break any remaining tie.
+
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, "*?[")
+}
+
+func validatePatterns(eventHandlers map[string]EventHandler) error {
+	for name := range eventHandlers {
+		if !isPattern(name) {
+			continue
+		}
+		if _, err := path.Match(name, ""); err != nil {
+			return errors.Wrapf(err, "Invalid event pattern %q", name)
+		}
+	}
+	return nil
+}
+
+func literalLength(pattern string) int {
+	n := 0
+	for _, r := range pattern {
+		if !strings.ContainsRune("*?[]\\", r) {
+			n++
+		}
+	}
+	return n
+}
+
+// morePrecise reports whether pattern a takes precedence over pattern b.
+func morePrecise(a, b string) bool {
+	if la, lb := literalLength(a), literalLength(b); la != lb {
+		return la > lb
+	}
+	return a < b
+}
+
+// resolveNames maps every event name to subscribe to onto the handler map key
+// that handles it: exact keys map to themselves and patterns are replaced by
+// the known names they match.
+func resolveNames(keys []string, knownNames []string) map[string]string {
+	resolved := map[string]string{}
+	patterns := []string{}
+	for _, key := range keys {
+		if isPattern(key) {
+			patterns = append(patterns, key)
+		} else {
+			resolved[key] = key
+		}
+	}
+	if len(patterns) == 0 {
+		return resolved
+	}
+	sort.Slice(patterns, func(i, j int) bool {
+		return morePrecise(patterns[i], patterns[j])
+	})
+
+	matched := map[string]bool{}
+	for _, name := range knownNames {
+		if _, ok := resolved[name]; ok {
+			continue
+		}
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(pattern, name); ok {
+				resolved[name] = pattern
+				matched[pattern] = true
+				break
+			}
+		}
+	}
+
+	for _, pattern := range patterns {
+		if !matched[pattern] {
+			log.WithFields(log.Fields{
+				"pattern": pattern,
+			}).Warn("Event pattern doesn't handle any known event names, because it matches none or more precise keys handle them all")
+		}
+	}
+	return resolved
+}
+
+// Routes maps each event name the router subscribes to, without any handler suffix, onto the
+// key of the handler map that handles it.
+func (router *EventRouter) Routes() map[string]string {
+	eventHandlers := router.handlers()
+	keys := make([]string, 0, len(eventHandlers))
+	for key := range eventHandlers {
+		keys = append(keys, key)
+	}
+	return resolveNames(keys, router.knownEventNames())
+}
+
+// knownEventNames returns KnownEventNames if set. Otherwise it derives the
+// names of the create, remove and action processes of every API schema.
+func (router *EventRouter) knownEventNames() []string {
+	if len(router.KnownEventNames) > 0 {
+		return router.KnownEventNames
+	}
+	if router.apiClient.GenericBaseClient == nil {
+		return nil
+	}
+
+	names := []string{}
+	for id, schema := range router.apiClient.GetTypes() {
+		id = strings.ToLower(id)
+		names = append(names, id+".create", id+".remove")
+		for action := range schema.ResourceActions {
+			if action == "create" || action == "remove" {
+				continue
+			}
+			names = append(names, id+"."+strings.ToLower(action))
+		}
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,143 @@
+package events
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+)
+
+// DefaultProgressInterval is the least time between two progress updates for the same event.
+const DefaultProgressInterval = time.Second
+
+// ProgressReporter publishes intermediate updates for a long-running handler
+// to the event's ReplyTo. Updates are published in order and at most once per
+// interval; an update that is throttled is kept and published once the
+// interval has passed, unless a newer one replaces it first. Pending updates always go out before the final
+// reply, and updates reported after it are dropped. Updates are sent by a
+// single goroutine, so a slow API never blocks the handler calling Report.
+type ProgressReporter struct {
+	mu        sync.Mutex
+	event     *Event
+	apiClient *client.GenericClient
+	interval  time.Duration
+	last      time.Time
+	pending   *client.Publish
+	flush     *time.Timer
+	closed    bool
+	queue     []*client.Publish
+	sent      chan struct{}
+}
+
+func newProgressReporter(event *Event, apiClient *client.GenericClient, interval time.Duration) *ProgressReporter {
+	return &ProgressReporter{
+		event:     event,
+		apiClient: apiClient,
+		interval:  interval,
+	}
+}
+
+// Progress returns the reporter for the event's handler. Outside of a handler
+// it returns a reporter that discards updates.
+func (e *Event) Progress() *ProgressReporter {
+	if e.progress == nil {
+		return &ProgressReporter{closed: true}
+	}
+	return e.progress
+}
+
+// Report publishes message and percent, a value from 0 to 100, unless the
+// previous update was too recent.
+func (p *ProgressReporter) Report(message string, percent int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed || p.event.ReplyTo == "" {
+		return
+	}
+
+	p.pending = &client.Publish{
+		Name:                  p.event.ReplyTo,
+		PreviousIds:           []string{p.event.ID},
+		ResourceId:            p.event.ResourceID,
+		ResourceType:          p.event.ResourceType,
+		Transitioning:         "yes",
+		TransitioningMessage:  message,
+		TransitioningProgress: &percent,
+	}
+	if since := time.Since(p.last); since >= p.interval {
+		p.publishPending()
+	} else if p.flush == nil {
+		p.flush = time.AfterFunc(p.interval-since, p.flushPending)
+	}
+}
+
+// flushPending publishes a throttled update once the interval has passed.
+func (p *ProgressReporter) flushPending() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.flush = nil
+	if !p.closed {
+		p.publishPending()
+	}
+}
+
+// close publishes any throttled update, stops the reporter taking more and
+// waits until every queued update has been sent.
+func (p *ProgressReporter) close() {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return
+	}
+	if p.flush != nil {
+		p.flush.Stop()
+		p.flush = nil
+	}
+	p.publishPending()
+	p.closed = true
+	sent := p.sent
+	p.mu.Unlock()
+	if sent != nil {
+		<-sent
+	}
+}
+
+// publishPending queues the pending update and starts the sender if it isn't
+// already running. It must be called with p.mu held.
+func (p *ProgressReporter) publishPending() {
+	if p.pending == nil {
+		return
+	}
+	p.queue = append(p.queue, p.pending)
+	p.pending = nil
+	p.last = time.Now()
+	if p.sent == nil {
+		p.sent = make(chan struct{})
+		go p.send(p.sent)
+	}
+}
+
+// send publishes queued updates in order until the queue is empty.
+func (p *ProgressReporter) send(sent chan struct{}) {
+	defer close(sent)
+	for {
+		p.mu.Lock()
+		if len(p.queue) == 0 {
+			p.sent = nil
+			p.mu.Unlock()
+			return
+		}
+		publish := p.queue[0]
+		p.queue = p.queue[1:]
+		p.mu.Unlock()
+
+		if _, err := p.apiClient.Publish.Create(publish); err != nil {
+			log.WithFields(log.Fields{
+				"eventId": p.event.ID,
+				"err":     err,
+			}).Warn("Error sending progress update")
+			notifyPublishFailed(p.event, err)
+		}
+	}
+}
@@ -0,0 +1,160 @@
+package events
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+)
+
+type overflowAction int
+
+const (
+	overflowDropNewest overflowAction = iota
+	overflowDropOldest
+	overflowBlock
+	overflowReplyError
+)
+
+// OverflowPolicy decides what a queueing worker pool does with an event when its queue is full.
+type OverflowPolicy struct {
+	action  overflowAction
+	timeout time.Duration
+}
+
+var (
+	// DropNewest discards the incoming event.
+	DropNewest = OverflowPolicy{action: overflowDropNewest}
+	// DropOldest discards the event at the head of the queue to make room for the incoming one.
+	DropOldest = OverflowPolicy{action: overflowDropOldest}
+	// ReplyWithError discards the incoming event and publishes an error reply to its ReplyTo.
+	ReplyWithError = OverflowPolicy{action: overflowReplyError}
+)
+
+// BlockWithTimeout waits up to timeout for room in the queue and then discards the incoming
+// event. Note that this blocks the read loop, so keep the timeout well below MaxPongWait.
+func BlockWithTimeout(timeout time.Duration) OverflowPolicy {
+	return OverflowPolicy{action: overflowBlock, timeout: timeout}
+}
+
+type queuedWork struct {
+	event         *Event
+	eventHandlers map[string]EventHandler
+	apiClient     *client.GenericClient
+}
+
+type queueingWorkerPool struct {
+	queue       chan *queuedWork
+	workerCount int
+	// running is how many workers are handling an event.
+	running     int32
+	overflow    OverflowPolicy
+	eventLocker EventLocker
+	inFlight    *inFlight
+}
+
+// QueueingWorkerPool returns a WorkerPool that buffers up to queueSize events
+// for size workers, applying overflow when the buffer is full. The workers exit
+// once the pool has been drained of every event.
+func QueueingWorkerPool(size, queueSize int, overflow OverflowPolicy, eventLocker EventLocker) WorkerPool {
+	if eventLocker == nil {
+		eventLocker = nopLocker
+	}
+	wp := &queueingWorkerPool{
+		queue:       make(chan *queuedWork, queueSize),
+		workerCount: size,
+		overflow:    overflow,
+		eventLocker: eventLocker,
+		inFlight:    newInFlight(),
+	}
+	wp.inFlight.onDrained = func() {
+		close(wp.queue)
+	}
+	for i := 0; i < size; i++ {
+		go wp.work()
+	}
+	return wp
+}
+
+func (wp *queueingWorkerPool) work() {
+	for item := range wp.queue {
+		atomic.AddInt32(&wp.running, 1)
+		doWork(item.event, item.eventHandlers, item.apiClient, wp.eventLocker(item.event), wp.inFlight, requeueTo(wp, wp.inFlight, item.eventHandlers, item.apiClient))
+		atomic.AddInt32(&wp.running, -1)
+		wp.inFlight.done(item.event)
+	}
+}
+
+func (wp *queueingWorkerPool) HandleWork(event *Event, eventHandlers map[string]EventHandler, apiClient *client.GenericClient) {
+	if !wp.inFlight.add(event) {
+		dropDraining(event, apiClient)
+		return
+	}
+	item := &queuedWork{event: event, eventHandlers: eventHandlers, apiClient: apiClient}
+
+	select {
+	case wp.queue <- item:
+		return
+	default:
+	}
+
+	switch wp.overflow.action {
+	case overflowDropOldest:
+		for {
+			select {
+			case oldest := <-wp.queue:
+				wp.drop(oldest, "Queue full, dropping oldest event", false)
+			default:
+			}
+			select {
+			case wp.queue <- item:
+				return
+			default:
+			}
+		}
+	case overflowBlock:
+		select {
+		case wp.queue <- item:
+			return
+		case <-time.After(wp.overflow.timeout):
+			wp.drop(item, "Queue full after waiting, dropping event", false)
+		}
+	case overflowReplyError:
+		wp.drop(item, "Queue full, rejecting event", true)
+	default:
+		wp.drop(item, "Queue full, dropping event", false)
+	}
+}
+
+// drop discards item, replying with an error if reply is set. A requeued event always gets an
+// error reply, since Cattle won't send it again.
+func (wp *queueingWorkerPool) drop(item *queuedWork, msg string, reply bool) {
+	event := item.event
+	wp.inFlight.done(event)
+	log.WithFields(log.Fields{
+		"workerCount": wp.workerCount,
+		"queueSize":   cap(wp.queue),
+		"event":       *event,
+	}).Warn(msg)
+	notifyDropped(event, DropQueueFull)
+	if (reply || event.requeues > 0) && event.Name != "ping" {
+		publishErrorReply(event, item.apiClient, fmt.Errorf("Event queue full. workerCount: %v, queueSize: %v", wp.workerCount, cap(wp.queue)))
+	}
+}
+
+func (wp *queueingWorkerPool) Drain(timeout time.Duration) error {
+	return wp.inFlight.drain(timeout)
+}
+
+// saturation counts queued events as well as running ones, but not those parked by an ordered
+// locker, which take neither a worker nor room in the queue.
+func (wp *queueingWorkerPool) saturation() float64 {
+	capacity := wp.workerCount + cap(wp.queue)
+	if capacity == 0 {
+		return 1
+	}
+	busy := len(wp.queue) + int(atomic.LoadInt32(&wp.running))
+	return float64(busy) / float64(capacity)
+}
@@ -0,0 +1,42 @@
+package events
+
+import (
+	"math/rand"
+	"time"
+)
+
+// ReconnectConfig controls how the router re-dials the event stream after the
+// connection is lost. Intervals are in milliseconds. A negative MaxRetries
+// retries forever; zero disables reconnecting.
+type ReconnectConfig struct {
+	InitialInterval int
+	MaxInterval     int
+	Multiplier      float64
+	MaxRetries      int
+}
+
+var DefaultReconnectConfig = ReconnectConfig{
+	InitialInterval: 500,
+	MaxInterval:     30000,
+	Multiplier:      2,
+	MaxRetries:      -1,
+}
+
+func (c ReconnectConfig) canRetry(attempt int) bool {
+	return c.MaxRetries < 0 || attempt < c.MaxRetries
+}
+
+// backoff returns how long to wait before the given (zero based) reconnect
+// attempt. The result is jittered between half and all of the exponential
+// interval so that a fleet of subscribers doesn't reconnect in lockstep.
+func (c ReconnectConfig) backoff(attempt int) time.Duration {
+	interval := float64(c.InitialInterval)
+	for i := 0; i < attempt && interval < float64(c.MaxInterval); i++ {
+		interval *= c.Multiplier
+	}
+	if c.MaxInterval > 0 && interval > float64(c.MaxInterval) {
+		interval = float64(c.MaxInterval)
+	}
+	jittered := interval/2 + rand.Float64()*interval/2
+	return time.Duration(jittered) * time.Millisecond
+}
@@ -0,0 +1,159 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// AddHandler registers handler under name, an event name or pattern, replacing any handler
+// already registered under it. On a running router the subscription is re-established with the
+// new set of event names.
+func (router *EventRouter) AddHandler(name string, handler EventHandler) error {
+	if err := validatePatterns(map[string]EventHandler{name: handler}); err != nil {
+		return err
+	}
+
+	router.handlersMu.Lock()
+	eventHandlers := make(map[string]EventHandler, len(router.eventHandlers)+1)
+	for key, fn := range router.eventHandlers {
+		eventHandlers[key] = fn
+	}
+	eventHandlers[name] = handler
+	router.eventHandlers = eventHandlers
+	router.handlersMu.Unlock()
+
+	router.requestResubscribe()
+	return nil
+}
+
+// RemoveHandler unregisters the handler registered under name. On a running router the
+// subscription is re-established without the event names it handled. Events already handed to
+// the worker pool still run.
+func (router *EventRouter) RemoveHandler(name string) error {
+	router.handlersMu.Lock()
+	if _, ok := router.eventHandlers[name]; !ok {
+		router.handlersMu.Unlock()
+		return fmt.Errorf("No handler registered for %s", name)
+	}
+	eventHandlers := make(map[string]EventHandler, len(router.eventHandlers))
+	for key, fn := range router.eventHandlers {
+		if key != name {
+			eventHandlers[key] = fn
+		}
+	}
+	router.eventHandlers = eventHandlers
+	router.handlersMu.Unlock()
+
+	router.requestResubscribe()
+	return nil
+}
+
+// handlers returns the registered handlers. The map must not be modified.
+func (router *EventRouter) handlers() map[string]EventHandler {
+	router.handlersMu.Lock()
+	defer router.handlersMu.Unlock()
+	return router.eventHandlers
+}
+
+func (router *EventRouter) requestResubscribe() {
+	select {
+	case router.resubscribe <- struct{}{}:
+	default:
+		// A resubscription is already pending and will pick up this change.
+	}
+}
+
+// subscription is an open event stream and the dispatch table it was subscribed with.
+type subscription struct {
+	stream EventStream
+	table  *dispatchTable
+}
+
+type handoff struct {
+	sub *subscription
+	err error
+}
+
+// subscribe builds the dispatch table from the current handlers and connects to the source.
+func (router *EventRouter) subscribe(ctx context.Context, eventSuffix string) (*subscription, error) {
+	// Whatever change was pending is part of this table.
+	select {
+	case <-router.resubscribe:
+	default:
+	}
+
+	table := router.buildDispatchTable(eventSuffix)
+	stream, err := router.source().Connect(ctx, table.eventNames)
+	if err != nil {
+		return nil, err
+	}
+	return &subscription{stream: stream, table: table}, nil
+}
+
+// watchResubscribe waits for the handlers to change while the current connection, which ends
+// with connCtx, is open. It then dials a new subscription before closing the current
+// connection, so that events keep flowing, and hands the result to the read loop. The new
+// subscription outlives the current connection, so it is dialed with the run's ctx. If dialing
+// fails the current connection is closed anyway and the read loop reconnects as usual.
+func (router *EventRouter) watchResubscribe(ctx, connCtx context.Context, eventSuffix string, closeCurrent func(), result chan<- *handoff) {
+	defer close(result)
+	select {
+	case <-connCtx.Done():
+		return
+	case <-router.resubscribe:
+	}
+
+	log.Info("Event handlers changed, resubscribing")
+	sub, err := router.subscribe(ctx, eventSuffix)
+	if err != nil && ctx.Err() != nil {
+		return
+	}
+	result <- &handoff{sub: sub, err: err}
+	closeCurrent()
+}
+
+// HandoffDedupeWindow is how long after switching to a new subscription the router skips
+// events that the previous one already delivered.
+const HandoffDedupeWindow = 10 * time.Second
+
+// recentIDs remembers the IDs of the events read in the last window, so that events delivered
+// by both the old and the new subscription of a handoff are only dispatched once. It is only
+// used by the read loop.
+type recentIDs struct {
+	window     time.Duration
+	ids        map[string]time.Time
+	swept      time.Time
+	checkUntil time.Time
+}
+
+func newRecentIDs(window time.Duration) *recentIDs {
+	return &recentIDs{window: window, ids: map[string]time.Time{}, swept: time.Now()}
+}
+
+// checkFor makes duplicate report repeated IDs for the next d.
+func (r *recentIDs) checkFor(d time.Duration) {
+	r.checkUntil = time.Now().Add(d)
+}
+
+// duplicate records id and reports whether it was already read in the last window while
+// duplicates are being checked for.
+func (r *recentIDs) duplicate(id string) bool {
+	if id == "" {
+		return false
+	}
+	now := time.Now()
+	if now.Sub(r.swept) > r.window {
+		for seen, at := range r.ids {
+			if now.Sub(at) > r.window {
+				delete(r.ids, seen)
+			}
+		}
+		r.swept = now
+	}
+	at, seen := r.ids[id]
+	r.ids[id] = now
+	return seen && now.Before(r.checkUntil) && now.Sub(at) <= r.window
+}
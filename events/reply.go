@@ -0,0 +1,86 @@
+package events
+
+import (
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+)
+
+// ReplyingEventHandler is a handler that returns a reply for the router to publish.
+type ReplyingEventHandler func(*Event, *client.GenericClient) (*ReplyEvent, error)
+
+// ReplyDataHandler is a handler that returns the Data of its reply.
+type ReplyDataHandler func(*Event, *client.GenericClient) (map[string]interface{}, error)
+
+// Replying adapts fn to an EventHandler. When fn succeeds and returns a
+// reply, the router publishes it to the event's ReplyTo. Name and
+// PreviousIds default to the event's ReplyTo and ID.
+func Replying(fn ReplyingEventHandler) EventHandler {
+	return func(event *Event, apiClient *client.GenericClient) error {
+		reply, err := fn(event, apiClient)
+		if err != nil {
+			return err
+		}
+		event.SetReply(reply)
+		return nil
+	}
+}
+
+// ReplyingWithData adapts fn to an EventHandler that replies with the returned data.
+func ReplyingWithData(fn ReplyDataHandler) EventHandler {
+	return Replying(func(event *Event, apiClient *client.GenericClient) (*ReplyEvent, error) {
+		data, err := fn(event, apiClient)
+		if err != nil {
+			return nil, err
+		}
+		reply := NewReplyEvent(event.ReplyTo, event.ID)
+		reply.Data = data
+		return reply, nil
+	})
+}
+
+func publishReply(event *Event, apiClient *client.GenericClient, reply *ReplyEvent) {
+	if event.ReplyTo == "" {
+		return
+	}
+	if reply.Name == "" {
+		reply.Name = event.ReplyTo
+	}
+	if len(reply.PreviousIds) == 0 {
+		reply.PreviousIds = []string{event.ID}
+	}
+
+	publish := &client.Publish{
+		Name:         reply.Name,
+		PreviousIds:  reply.PreviousIds,
+		ResourceId:   event.ResourceID,
+		ResourceType: event.ResourceType,
+		Data:         reply.Data,
+	}
+	if _, err := apiClient.Publish.Create(publish); err != nil {
+		log.WithFields(log.Fields{
+			"eventId": event.ID,
+			"err":     err,
+		}).Error("Error sending reply")
+		notifyPublishFailed(event, err)
+	}
+}
+
+func publishErrorReply(event *Event, apiClient *client.GenericClient, handlerErr error) {
+	if event.ReplyTo == "" {
+		return
+	}
+
+	reply := &client.Publish{
+		Name:                 event.ReplyTo,
+		PreviousIds:          []string{event.ID},
+		Transitioning:        "error",
+		TransitioningMessage: handlerErr.Error(),
+		Data:                 errorReplyData(handlerErr),
+	}
+	if _, err := apiClient.Publish.Create(reply); err != nil {
+		log.WithFields(log.Fields{
+			"err": err,
+		}).Error("Error sending error-reply")
+		notifyPublishFailed(event, err)
+	}
+}
@@ -0,0 +1,84 @@
+package events
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+	"github.com/pkg/errors"
+)
+
+// RetryPolicy says how often and how soon a failed handler call is retried
+// before the router publishes an error reply.
+type RetryPolicy struct {
+	// MaxAttempts is the total number of calls, including the first.
+	MaxAttempts    int
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Retryable decides which errors are worth retrying. If nil, errors marked with Retryable
+	// and server errors from the API are retried.
+	Retryable func(error) bool
+}
+
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    3,
+	InitialBackoff: 500 * time.Millisecond,
+	MaxBackoff:     10 * time.Second,
+	Multiplier:     2,
+}
+
+// IsServerError reports whether err, or the error it wraps, is an *client.ApiError with a 5xx
+// status code.
+func IsServerError(err error) bool {
+	apiError, ok := errors.Cause(err).(*client.ApiError)
+	return ok && apiError.StatusCode >= 500
+}
+
+func isRetryable(err error) bool {
+	if handlerErr, ok := AsHandlerError(err); ok {
+		return handlerErr.Kind == ErrorRetryable
+	}
+	return IsServerError(err)
+}
+
+// Retry returns a middleware that retries the handler according to policy.
+// It runs inside the worker that called the handler, so any resource lock
+// stays held between attempts. Retrying stops early if the event's deadline
+// passes.
+func Retry(policy RetryPolicy) Middleware {
+	retryable := policy.Retryable
+	if retryable == nil {
+		retryable = isRetryable
+	}
+	return func(next EventHandler) EventHandler {
+		return func(event *Event, apiClient *client.GenericClient) error {
+			backoff := policy.InitialBackoff
+			for attempt := 1; ; attempt++ {
+				err := next(event, apiClient)
+				if err == nil || attempt >= policy.MaxAttempts || !retryable(err) {
+					return err
+				}
+
+				log.WithFields(log.Fields{
+					"eventName": event.Name,
+					"eventId":   event.ID,
+					"attempt":   attempt,
+					"backoff":   backoff,
+					"err":       err,
+				}).Warn("Retrying event handler")
+
+				select {
+				case <-event.Context().Done():
+					return err
+				case <-time.After(backoff):
+				}
+
+				backoff = time.Duration(float64(backoff) * policy.Multiplier)
+				if policy.MaxBackoff > 0 && backoff > policy.MaxBackoff {
+					backoff = policy.MaxBackoff
+				}
+			}
+		}
+	}
+}
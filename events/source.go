@@ -0,0 +1,58 @@
+package events
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// EventSource is where an EventRouter gets its events from. The router connects once it is
+// started, and connects again to reconnect or when its handlers change.
+type EventSource interface {
+	// Connect opens a stream of events. eventNames are the names the router has handlers for;
+	// a source may deliver other events, which the router drops.
+	Connect(ctx context.Context, eventNames []string) (EventStream, error)
+}
+
+// EventStream is one connection of an EventSource.
+type EventStream interface {
+	// Next blocks until the next event arrives. It returns io.EOF when the source has no more
+	// events, and any other error when the connection is lost; an *ExitError gives the reason
+	// the router reports.
+	Next() (*Event, error)
+	// Close ends the stream, making a blocked Next return. It is safe to call more than once.
+	Close() error
+}
+
+// ChannelSource is an EventSource that reads events from a channel, for tests and for feeding
+// events from other code in the same process. Closing the channel ends the stream with io.EOF.
+type ChannelSource chan *Event
+
+func (s ChannelSource) Connect(ctx context.Context, eventNames []string) (EventStream, error) {
+	return &channelStream{events: s, closed: make(chan struct{})}, nil
+}
+
+type channelStream struct {
+	events    <-chan *Event
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *channelStream) Next() (*Event, error) {
+	select {
+	case event, ok := <-s.events:
+		if !ok {
+			return nil, io.EOF
+		}
+		return event, nil
+	case <-s.closed:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+func (s *channelStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
@@ -0,0 +1,66 @@
+package events
+
+import (
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Stats counts what an EventRouter has done with the events it received.
+type Stats struct {
+	Received uint64
+	Handled  uint64
+	Failed   uint64
+	Panics   uint64
+	// Abandoned counts handlers that were still running AbandonAfter past their timeout.
+	Abandoned uint64
+}
+
+type routerStats struct {
+	received  uint64
+	handled   uint64
+	failed    uint64
+	panics    uint64
+	abandoned uint64
+}
+
+// Stats returns a snapshot of the router's counters.
+func (router *EventRouter) Stats() Stats {
+	return Stats{
+		Received:  atomic.LoadUint64(&router.stats.received),
+		Handled:   atomic.LoadUint64(&router.stats.handled),
+		Failed:    atomic.LoadUint64(&router.stats.failed),
+		Panics:    atomic.LoadUint64(&router.stats.panics),
+		Abandoned: atomic.LoadUint64(&router.stats.abandoned),
+	}
+}
+
+// statsFor returns the stats of the router that received event, or nil if it didn't come from a router.
+func statsFor(event *Event) *routerStats {
+	if event.router == nil {
+		return nil
+	}
+	return &event.router.stats
+}
+
+// recoverPanic must be deferred. It turns a panic while handling event into
+// an error stored in err, logging the stack trace.
+func recoverPanic(event *Event, err *error) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	log.WithFields(log.Fields{
+		"eventName":    event.Name,
+		"eventId":      event.ID,
+		"resourceType": event.ResourceType,
+		"resourceId":   event.ResourceID,
+		"panic":        r,
+	}).Errorf("Recovered panic in event handler\n%s", debug.Stack())
+	if stats := statsFor(event); stats != nil {
+		atomic.AddUint64(&stats.panics, 1)
+	}
+	*err = fmt.Errorf("Panic handling event: %v", r)
+}
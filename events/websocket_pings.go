@@ -20,22 +20,28 @@ var DefaultPingConfig = PingConfig{
 	MaxPongWait:       10000,
 }
 
-func (router *EventRouter) sendWebsocketPings() {
+func (router *EventRouter) sendWebsocketPings(eventStream *websocket.Conn, done <-chan struct{}) {
 	log.Infof("Starting websocket pings")
 	ticker := time.NewTicker(time.Millisecond * time.Duration(router.PingConfig.SendPingInterval))
 	defer ticker.Stop()
-	for range ticker.C {
-		if err := router.eventStream.WriteControl(websocket.PingMessage, []byte(""), time.Now().Add(time.Second)); err != nil {
-			// websocket closed, return
-			log.Warnf("websocket closed: %s", err)
+	for {
+		select {
+		case <-done:
 			return
+		case <-ticker.C:
+			if err := eventStream.WriteControl(websocket.PingMessage, []byte(""), time.Now().Add(time.Second)); err != nil {
+				// websocket closed, return
+				log.Warnf("websocket closed: %s", err)
+				return
+			}
 		}
 	}
 }
 
-func newPongHandler(r *EventRouter) *pongHandler {
+func newPongHandler(r *EventRouter, eventStream *websocket.Conn) *pongHandler {
 	ph := &pongHandler{
 		r:        r,
+		conn:     eventStream,
 		mu:       &sync.Mutex{},
 		lastPing: time.Now(),
 		done:     make(chan bool),
@@ -48,8 +54,11 @@ func newPongHandler(r *EventRouter) *pongHandler {
 
 type pongHandler struct {
 	r        *EventRouter
+	conn     *websocket.Conn
 	mu       *sync.Mutex
 	lastPing time.Time
+	gotPing  bool
+	timeout  bool
 	done     chan bool
 }
 
@@ -68,7 +77,11 @@ func (h *pongHandler) startTimer(checkInterval, maxWait int) {
 			if time.Now().After(timeoutAt) {
 				// bad!
 				log.Infof("Hit websocket pong timeout. Last websocket ping received at %v. Closing connection.", t)
-				h.r.Stop()
+				h.mu.Lock()
+				h.timeout = true
+				h.mu.Unlock()
+				h.conn.Close()
+				return
 			}
 		}
 	}
@@ -78,9 +91,31 @@ func (h *pongHandler) handle(appData string) error {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.lastPing = time.Now()
+	h.gotPing = true
+	h.r.notify(func(o Observer) {
+		o.PongReceived()
+	})
 	return nil
 }
 
+func (h *pongHandler) gotPong() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.gotPing
+}
+
+func (h *pongHandler) lastPong() time.Time {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.lastPing
+}
+
+func (h *pongHandler) timedOut() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.timeout
+}
+
 func (h *pongHandler) stop() {
-	h.done <- true
+	close(h.done)
 }
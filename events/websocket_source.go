@@ -0,0 +1,162 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/gorilla/websocket"
+)
+
+var slashRegex = regexp.MustCompile("[/]{2,}")
+
+// websocketSource subscribes to the Cattle event websocket. It is the router's source unless
+// EventRouter.Source is set, and reads the subscribe URL, credentials and PingConfig from the
+// router.
+type websocketSource struct {
+	router *EventRouter
+}
+
+func (s *websocketSource) Connect(ctx context.Context, eventNames []string) (EventStream, error) {
+	router := s.router
+	accessKey := ""
+	secretKey := ""
+	if router.apiClient.GenericBaseClient != nil {
+		accessKey = router.apiClient.GetOpts().SecretID
+		secretKey = router.apiClient.GetOpts().SecretKey
+	}
+
+	data := url.Values{}
+	for _, name := range eventNames {
+		data.Add("eventNames", name)
+	}
+	conn, err := router.subscribeToEvents(ctx, router.subscribeURL, accessKey, secretKey, data)
+	if err != nil {
+		return nil, err
+	}
+
+	stream := &websocketStream{
+		router: router,
+		conn:   conn,
+		pong:   newPongHandler(router, conn),
+		done:   make(chan struct{}),
+	}
+	conn.SetPongHandler(stream.pong.handle)
+	go router.sendWebsocketPings(conn, stream.done)
+	return stream, nil
+}
+
+type websocketStream struct {
+	router    *EventRouter
+	conn      *websocket.Conn
+	pong      *pongHandler
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *websocketStream) Next() (*Event, error) {
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil {
+			// Error here means the connection is closed, either by us or because it was lost.
+			if s.pong.timedOut() {
+				return nil, &ExitError{Reason: ExitPongTimeout, Err: err}
+			}
+			return nil, err
+		}
+
+		message = bytes.TrimSpace(message)
+		if len(message) == 0 {
+			continue
+		}
+
+		event := &Event{}
+		err = json.Unmarshal(message, &event)
+		if err != nil {
+			log.WithFields(log.Fields{
+				"message": string(message),
+			}).Warnf("Error parsing message: %s", err)
+			s.router.notify(func(o Observer) {
+				o.MessageMalformed(message, err)
+			})
+			continue
+		}
+		event.raw = message
+		return event, nil
+	}
+}
+
+func (s *websocketStream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		s.pong.stop()
+		s.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""), time.Now().Add(time.Second))
+	})
+	return s.conn.Close()
+}
+
+// gotPong reports whether the server answered a ping, which makes the connection healthy even
+// if no event arrived on it.
+func (s *websocketStream) gotPong() bool {
+	return s.pong.gotPong()
+}
+
+func (s *websocketStream) lastPong() time.Time {
+	return s.pong.lastPong()
+}
+
+func (router *EventRouter) subscribeToEvents(ctx context.Context, subscribeURL string, accessKey string, secretKey string, data url.Values) (*websocket.Conn, error) {
+	// gorilla websocket will blow up if the path starts with //
+	parsed, err := url.Parse(subscribeURL)
+	if err != nil {
+		return nil, err
+	}
+	if strings.HasPrefix(parsed.Path, "//") {
+		parsed.Path = slashRegex.ReplaceAllString(parsed.Path, "/")
+		subscribeURL = parsed.String()
+	}
+
+	dialer := &websocket.Dialer{
+		HandshakeTimeout: time.Second * 30,
+		NetDial: func(network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, network, addr)
+		},
+	}
+	headers := http.Header{}
+	headers.Add("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(accessKey+":"+secretKey)))
+	subscribeURL = subscribeURL + "?" + data.Encode()
+	ws, resp, err := dialer.Dial(subscribeURL, headers)
+
+	if err != nil {
+		log.WithFields(log.Fields{
+			"subscribeUrl": subscribeURL,
+		}).Errorf("Error subscribing to events: %s", err)
+		if resp != nil {
+			log.WithFields(log.Fields{
+				"status":          resp.Status,
+				"statusCode":      resp.StatusCode,
+				"responseHeaders": resp.Header,
+			}).Error("Got error response")
+			if resp.Body != nil {
+				defer resp.Body.Close()
+				body, _ := ioutil.ReadAll(resp.Body)
+				log.Errorf("Error response: %s", body)
+			}
+		}
+		if ws != nil {
+			ws.Close()
+		}
+		return nil, err
+	}
+	return ws, nil
+}
@@ -1,17 +1,24 @@
 package events
 
 import (
+	"context"
 	"fmt"
+	"sync/atomic"
+	"time"
+
 	log "github.com/Sirupsen/logrus"
 	"github.com/chenleji/event-subscriber/client"
 	"github.com/chenleji/event-subscriber/locks"
+	"github.com/pkg/errors"
 )
 
 type EventLocker func(event *Event) locks.Locker
 
 func nopLocker(_ *Event) locks.Locker { return locks.NopLocker() }
 
-func resourceIDLocker(event *Event) locks.Locker {
+// ResourceIDLocker is the default EventLocker. It locks on the event's resource so that only one
+// event per resource is handled at a time.
+func ResourceIDLocker(event *Event) locks.Locker {
 	if event.ResourceID == "" {
 		return locks.NopLocker()
 	}
@@ -21,19 +28,22 @@ func resourceIDLocker(event *Event) locks.Locker {
 
 type WorkerPool interface {
 	HandleWork(event *Event, eventHandlers map[string]EventHandler, apiClient *client.GenericClient)
-
+	// Drain stops the pool from taking new work and waits up to timeout for running handlers
+	// to finish. It returns a *DrainError listing the events that were still running.
+	Drain(timeout time.Duration) error
 }
 
 type skippingWorkerPool struct {
 	workers     chan int
 	eventLocker EventLocker
+	inFlight    *inFlight
 }
 
 func SkippingWorkerPool(size int, eventLocker EventLocker) WorkerPool {
 	if eventLocker == nil {
 		eventLocker = nopLocker
 	}
-	wp := &skippingWorkerPool{workers: make(chan int, size), eventLocker: eventLocker}
+	wp := &skippingWorkerPool{workers: make(chan int, size), eventLocker: eventLocker, inFlight: newInFlight()}
 	for i := 0; i < size; i++ {
 		wp.workers <- i
 	}
@@ -41,23 +51,49 @@ func SkippingWorkerPool(size int, eventLocker EventLocker) WorkerPool {
 }
 
 func (wp *skippingWorkerPool) HandleWork(event *Event, eventHandlers map[string]EventHandler, apiClient *client.GenericClient) {
+	if !wp.inFlight.add(event) {
+		dropDraining(event, apiClient)
+		return
+	}
 	select {
 	case w := <-wp.workers:
 		go func() {
+			defer wp.inFlight.done(event)
 			defer func() { wp.workers <- w }()
-			doWork(event, eventHandlers, apiClient, wp.eventLocker(event))
+			doWork(event, eventHandlers, apiClient, wp.eventLocker(event), wp.inFlight, requeueTo(wp, wp.inFlight, eventHandlers, apiClient))
 		}()
 	default:
+		wp.inFlight.done(event)
 		log.Warnf("No workers available, dropping event. workerCount: %v, event: %v", cap(wp.workers), *event)
+		notifyDropped(event, DropNoWorker)
+		if event.requeues > 0 {
+			// Cattle won't send a requeued event again, so it must not be left unanswered.
+			publishErrorReply(event, apiClient, fmt.Errorf("No workers available to handle requeued event %s. workerCount: %v", event.Name, cap(wp.workers)))
+		}
 	}
 }
 
+func (wp *skippingWorkerPool) Drain(timeout time.Duration) error {
+	return wp.inFlight.drain(timeout)
+}
+
+// saturation counts busy workers. Events parked by an ordered locker are in flight but take no
+// worker until they run, so they aren't counted.
+func (wp *skippingWorkerPool) saturation() float64 {
+	if cap(wp.workers) == 0 {
+		// A pool without workers can never take an event.
+		return 1
+	}
+	return float64(cap(wp.workers)-len(wp.workers)) / float64(cap(wp.workers))
+}
+
 type nonSkippingWorkerPool struct {
-	workers chan int
+	workers  chan int
+	inFlight *inFlight
 }
 
 func NonSkippingWorkerPool(size int) WorkerPool {
-	wp := &nonSkippingWorkerPool{workers: make(chan int, size)}
+	wp := &nonSkippingWorkerPool{workers: make(chan int, size), inFlight: newInFlight()}
 	go func() {
 		for i := 0; i < size; i++ {
 			wp.workers <- i
@@ -67,54 +103,264 @@ func NonSkippingWorkerPool(size int) WorkerPool {
 }
 
 func (wp *nonSkippingWorkerPool) HandleWork(event *Event, eventHandlers map[string]EventHandler, apiClient *client.GenericClient) {
+	if !wp.inFlight.add(event) {
+		dropDraining(event, apiClient)
+		return
+	}
 	w := <-wp.workers
 	go func() {
+		defer wp.inFlight.done(event)
 		defer func() { wp.workers <- w }()
-		doWork(event, eventHandlers, apiClient, nopLocker(event))
+		doWork(event, eventHandlers, apiClient, nopLocker(event), wp.inFlight, requeueTo(wp, wp.inFlight, eventHandlers, apiClient))
 	}()
 }
 
-func doWork(event *Event, eventHandlers map[string]EventHandler, apiClient *client.GenericClient, locker locks.Locker) {
+func (wp *nonSkippingWorkerPool) Drain(timeout time.Duration) error {
+	return wp.inFlight.drain(timeout)
+}
+
+func (wp *nonSkippingWorkerPool) saturation() float64 {
+	if cap(wp.workers) == 0 {
+		return 1
+	}
+	return float64(cap(wp.workers)-len(wp.workers)) / float64(cap(wp.workers))
+}
+
+// requeueFunc hands an event back to the worker pool after a delay.
+type requeueFunc func(event *Event, delay time.Duration)
+
+func requeueTo(wp WorkerPool, f *inFlight, eventHandlers map[string]EventHandler, apiClient *client.GenericClient) requeueFunc {
+	return func(event *Event, delay time.Duration) {
+		f.requeue(event, delay, apiClient, func() {
+			wp.HandleWork(event, eventHandlers, apiClient)
+		})
+	}
+}
+
+// limitRequeues turns a request to requeue an event that has been requeued MaxRequeues times
+// already into a permanent error, so that a handler can't keep an event going forever.
+func limitRequeues(event *Event, err error) error {
+	handlerErr, ok := AsHandlerError(err)
+	if !ok || handlerErr.Kind != ErrorRequeue {
+		return err
+	}
+	maxRequeues := DefaultMaxRequeues
+	if event.router != nil {
+		maxRequeues = event.router.MaxRequeues
+	}
+	if event.requeues < maxRequeues {
+		return err
+	}
+	return Permanent(errors.Wrapf(err, "Gave up after %d requeues", event.requeues))
+}
+
+// doWork handles event under locker. If tracker is not nil, an event parked by an ordered
+// locker is tracked there until it has been handled, since the worker that parked it moves on.
+func doWork(event *Event, eventHandlers map[string]EventHandler, apiClient *client.GenericClient, locker locks.Locker, tracker *inFlight, requeue requeueFunc) {
 	if event.Name != "ping" {
 		log.WithFields(log.Fields{
 			"event": *event,
 		}).Debug("Processing event.")
 	}
 
-	unlocker := locker.Lock()
-	if unlocker == nil {
+	var unlocker locks.Unlocker
+	if ol, ok := locker.(orderedLocker); ok {
+		// Hold the event before it can be parked, as it may run as soon as it is.
+		tracker.hold(event)
+		unlocker = ol.lockOrPark(event, func() {
+			defer tracker.done(event)
+			handleEvent(event, eventHandlers, apiClient, requeue)
+		}, func() {
+			tracker.done(event)
+		})
+		if unlocker == nil {
+			// Parked until the resource is free, or dropped. The locker logs which.
+			return
+		}
+		tracker.done(event)
+	} else {
+		unlocker = locker.Lock()
+		if unlocker == nil {
+			log.WithFields(log.Fields{
+				"resourceId": event.ResourceID,
+			}).Debug("Resource locked. Dropping event")
+			notifyDropped(event, DropLocked)
+			return
+		}
+	}
+	defer unlocker.Unlock()
+
+	handleEvent(event, eventHandlers, apiClient, requeue)
+}
+
+func handleEvent(event *Event, eventHandlers map[string]EventHandler, apiClient *client.GenericClient, requeue requeueFunc) {
+	fn, ok := eventHandlers[event.Name]
+	if !ok {
 		log.WithFields(log.Fields{
-			"resourceId": event.ResourceID,
-		}).Debug("Resource locked. Dropping event")
+			"eventName": event.Name,
+		}).Warn("No event handler registered for event")
+		notifyDropped(event, DropNoHandler)
 		return
 	}
-	defer unlocker.Unlock()
 
-	if fn, ok := eventHandlers[event.Name]; ok {
-		if err := fn(event, apiClient); err != nil {
+	stats := statsFor(event)
+	event.reply = nil
+	progressInterval := DefaultProgressInterval
+	if event.router != nil {
+		progressInterval = event.router.ProgressInterval
+	}
+	event.progress = newProgressReporter(event, apiClient, progressInterval)
+	notify(event, func(o Observer) {
+		o.HandlerStarted(event)
+	})
+	start := time.Now()
+	timedOut, err := callHandlerWithDeadline(fn, event, apiClient)
+	err = limitRequeues(event, err)
+	event.progress.close()
+	notify(event, func(o Observer) {
+		o.HandlerFinished(event, time.Since(start), err)
+	})
+	if timedOut {
+		if stats != nil {
+			atomic.AddUint64(&stats.failed, 1)
+		}
+		return
+	}
+	if handlerErr, ok := AsHandlerError(err); ok {
+		switch handlerErr.Kind {
+		case ErrorIgnore:
 			log.WithFields(log.Fields{
-				"eventName":  event.Name,
-				"eventId":    event.ID,
-				"resourceId": event.ResourceID,
-				"err":        err,
-			}).Error("Error processing event")
-
-			reply := &client.Publish{
-				Name:                 event.ReplyTo,
-				PreviousIds:          []string{event.ID},
-				Transitioning:        "error",
-				TransitioningMessage: err.Error(),
-			}
-			_, err := apiClient.Publish.Create(reply)
-			if err != nil {
-				log.WithFields(log.Fields{
-					"err": err,
-				}).Error("Error sending error-reply")
+				"eventName": event.Name,
+				"eventId":   event.ID,
+				"reason":    handlerErr,
+			}).Debug("Handler ignored event")
+			if stats != nil {
+				atomic.AddUint64(&stats.handled, 1)
 			}
+			return
+		case ErrorRequeue:
+			log.WithFields(log.Fields{
+				"eventName": event.Name,
+				"eventId":   event.ID,
+				"delay":     handlerErr.Delay,
+				"reason":    handlerErr,
+			}).Info("Requeueing event")
+			event.requeues++
+			requeue(event, handlerErr.Delay)
+			return
 		}
-	} else {
+	}
+	if err != nil {
 		log.WithFields(log.Fields{
-			"eventName": event.Name,
-		}).Warn("No event handler registered for event")
+			"eventName":  event.Name,
+			"eventId":    event.ID,
+			"resourceId": event.ResourceID,
+			"err":        err,
+		}).Error("Error processing event")
+
+		if stats != nil {
+			atomic.AddUint64(&stats.failed, 1)
+		}
+		publishErrorReply(event, apiClient, err)
+		return
+	}
+
+	if stats != nil {
+		atomic.AddUint64(&stats.handled, 1)
+	}
+	if reply := event.Reply(); reply != nil {
+		publishReply(event, apiClient, reply)
+	}
+}
+
+// DefaultAbandonAfter is how long a handler may run past its timeout before it is abandoned.
+const DefaultAbandonAfter = 30 * time.Second
+
+// callHandlerWithDeadline runs fn under the event's timeout. If the deadline
+// passes first, it publishes a timeout error reply straight away but still
+// waits for fn to return, so that the worker and resource lock stay held
+// until the handler has actually given up. A handler that is still running
+// AbandonAfter past its deadline is abandoned: it keeps its goroutine, but
+// its worker and lock are released.
+func callHandlerWithDeadline(fn EventHandler, event *Event, apiClient *client.GenericClient) (bool, error) {
+	timeout := event.Timeout()
+	if timeout <= 0 {
+		return false, callHandler(fn, event, apiClient)
+	}
+
+	parent := event.ctx
+	ctx, cancel := context.WithTimeout(event.Context(), timeout)
+	defer cancel()
+	event.ctx = ctx
+	abandoned := false
+	// Restore the parent so that a requeued event doesn't start out with an expired context.
+	// An abandoned handler may still be using the event, so it is left alone.
+	defer func() {
+		if !abandoned {
+			event.ctx = parent
+		}
+	}()
+
+	result := make(chan error, 1)
+	go func() {
+		result <- callHandler(fn, event, apiClient)
+	}()
+
+	select {
+	case err := <-result:
+		return false, err
+	case <-ctx.Done():
+	}
+
+	err := fmt.Errorf("Timed out after %v handling event %s", timeout, event.Name)
+	log.WithFields(log.Fields{
+		"eventName":  event.Name,
+		"eventId":    event.ID,
+		"resourceId": event.ResourceID,
+		"timeout":    timeout,
+	}).Error("Event handler timed out")
+	event.progress.close()
+	publishErrorReply(event, apiClient, err)
+
+	abandonAfter := DefaultAbandonAfter
+	if event.router != nil {
+		abandonAfter = event.router.AbandonAfter
 	}
+	var abandon <-chan time.Time
+	if abandonAfter > 0 {
+		timer := time.NewTimer(abandonAfter)
+		defer timer.Stop()
+		abandon = timer.C
+	}
+
+	select {
+	case err := <-result:
+		if err != nil {
+			log.WithFields(log.Fields{
+				"eventId": event.ID,
+				"err":     err,
+			}).Debug("Timed out event handler returned")
+		}
+	case <-abandon:
+		abandoned = true
+		log.WithFields(log.Fields{
+			"eventName":    event.Name,
+			"eventId":      event.ID,
+			"resourceId":   event.ResourceID,
+			"abandonAfter": abandonAfter,
+		}).Error("Event handler ignored its timeout. Abandoning it and releasing its worker")
+		if stats := statsFor(event); stats != nil {
+			atomic.AddUint64(&stats.abandoned, 1)
+		}
+		notify(event, func(o Observer) {
+			o.HandlerAbandoned(event)
+		})
+	}
+	return true, err
+}
+
+// callHandler runs fn, turning a panic into an error so that it gets an error reply like any other failure.
+func callHandler(fn EventHandler, event *Event, apiClient *client.GenericClient) (err error) {
+	defer recoverPanic(event, &err)
+	return fn(event, apiClient)
 }
@@ -0,0 +1,239 @@
+// Package handlers provides EventHandlers that hand events to something outside
+// the process, such as a command or a web hook.
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+	"github.com/chenleji/event-subscriber/events"
+)
+
+// DefaultStderrTail is how many bytes at the end of a failed command's stderr go into the error.
+const DefaultStderrTail = 4096
+
+// DefaultMaxStdout is how many bytes a command may print to stdout before its event fails.
+const DefaultMaxStdout = 1024 * 1024
+
+// ExecConfig describes a command that handles events.
+type ExecConfig struct {
+	Command string
+	Args    []string
+	// Env is added to the environment the subscriber runs with, as "KEY=value" pairs.
+	Env []string
+	Dir string
+	// Timeout limits how long the command may run, on top of the event's own timeout. Zero means
+	// only the event's timeout applies.
+	Timeout time.Duration
+	// MaxConcurrent limits how many instances of the command, with the same Args, run at once
+	// across every handler Exec returns for it, so routes that run the same command share it.
+	// The first of those handlers with a limit sets it, and a handler with a different one
+	// logs a warning. Zero means no limit.
+	MaxConcurrent int
+	// StderrTail is how many bytes of stderr to keep for the error. If zero, DefaultStderrTail.
+	StderrTail int
+	// MaxStdout is how many bytes the command may print to stdout; the event fails if it prints
+	// more. If zero, DefaultMaxStdout.
+	MaxStdout int
+}
+
+var (
+	slotsMu sync.Mutex
+	// commandSlots holds the semaphore of each command line with a MaxConcurrent. Entries are
+	// kept for the life of the process, one for each command line handlers were created for.
+	commandSlots = map[string]chan struct{}{}
+)
+
+// CommandLine returns the key under which the handlers that run command with args share their
+// MaxConcurrent limit.
+func CommandLine(command string, args []string) string {
+	return strings.Join(append([]string{command}, args...), "\x00")
+}
+
+// slotsFor returns the semaphore shared by the handlers that run config's command line, or nil
+// if config sets no limit.
+func slotsFor(config ExecConfig) chan struct{} {
+	if config.MaxConcurrent <= 0 {
+		return nil
+	}
+	key := CommandLine(config.Command, config.Args)
+	slotsMu.Lock()
+	defer slotsMu.Unlock()
+	slots, ok := commandSlots[key]
+	if !ok {
+		slots = make(chan struct{}, config.MaxConcurrent)
+		commandSlots[key] = slots
+	} else if cap(slots) != config.MaxConcurrent {
+		log.WithFields(log.Fields{
+			"command":       config.Command,
+			"args":          config.Args,
+			"maxConcurrent": config.MaxConcurrent,
+			"limit":         cap(slots),
+		}).Warn("Command already has a different concurrency limit, keeping it")
+	}
+	return slots
+}
+
+// Exec returns a handler that runs the command for each event. The event's JSON is written to
+// the command's stdin, and EVENT_NAME, EVENT_ID, REPLY_TO, RESOURCE_TYPE and RESOURCE_ID are
+// set in its environment. If the command prints a JSON object to stdout, it becomes the Data of
+// the reply. A command that exits non-zero fails the event with the tail of its stderr, and one
+// that prints more than MaxStdout bytes to stdout fails it too. When the timeout passes or the
+// event's context is cancelled, the command's whole process group is killed. A command killed at its own Timeout fails with a Retryable error, and one killed
+// because the event's context is done with a Permanent one, since retrying can't help it.
+func Exec(config ExecConfig) events.EventHandler {
+	if config.StderrTail <= 0 {
+		config.StderrTail = DefaultStderrTail
+	}
+	if config.MaxStdout <= 0 {
+		config.MaxStdout = DefaultMaxStdout
+	}
+	slots := slotsFor(config)
+
+	return events.Replying(func(event *events.Event, apiClient *client.GenericClient) (*events.ReplyEvent, error) {
+		ctx := event.Context()
+		if config.Timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, config.Timeout)
+			defer cancel()
+		}
+
+		if slots != nil {
+			select {
+			case slots <- struct{}{}:
+				defer func() { <-slots }()
+			case <-ctx.Done():
+				waitErr := fmt.Errorf("Waiting for %s to be free: %v", config.Command, ctx.Err())
+				if event.Context().Err() != nil {
+					return nil, events.Permanent(waitErr)
+				}
+				return nil, events.Retryable(waitErr)
+			}
+		}
+
+		stdout, err := runCommand(ctx, config, event)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := events.NewReplyEvent(event.ReplyTo, event.ID)
+		stdout = bytes.TrimSpace(stdout)
+		if len(stdout) > 0 {
+			if err := json.Unmarshal(stdout, &reply.Data); err != nil {
+				return nil, events.Permanent(fmt.Errorf("%s printed invalid reply data: %v", config.Command, err))
+			}
+		}
+		return reply, nil
+	})
+}
+
+func runCommand(ctx context.Context, config ExecConfig, event *events.Event) ([]byte, error) {
+	input := []byte(event.Raw())
+	if input == nil {
+		var err error
+		if input, err = json.Marshal(event); err != nil {
+			return nil, err
+		}
+	}
+
+	cmd := exec.Command(config.Command, config.Args...)
+	cmd.Dir = config.Dir
+	cmd.Env = append(os.Environ(),
+		"EVENT_NAME="+event.Name,
+		"EVENT_ID="+event.ID,
+		"REPLY_TO="+event.ReplyTo,
+		"RESOURCE_TYPE="+event.ResourceType,
+		"RESOURCE_ID="+event.ResourceID,
+	)
+	cmd.Env = append(cmd.Env, config.Env...)
+	cmd.Stdin = bytes.NewReader(input)
+	stdout := &limitBuffer{max: config.MaxStdout}
+	stderr := &tailBuffer{max: config.StderrTail}
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+	setProcessGroup(cmd)
+
+	if err := cmd.Start(); err != nil {
+		return nil, events.Permanent(fmt.Errorf("Starting %s: %v", config.Command, err))
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if stdout.overflowed {
+			return nil, events.Permanent(fmt.Errorf("%s printed more than %d bytes to stdout", config.Command, config.MaxStdout))
+		}
+		if err != nil {
+			exitErr := events.Permanent(fmt.Errorf("%s failed: %v: %s", config.Command, err, strings.TrimSpace(stderr.String())))
+			return nil, exitErr.WithCode("execFailed", map[string]interface{}{"exitError": err.Error()})
+		}
+		return stdout.Bytes(), nil
+	case <-ctx.Done():
+		if err := killProcessGroup(cmd); err != nil {
+			log.WithFields(log.Fields{
+				"command": config.Command,
+				"pid":     cmd.Process.Pid,
+				"err":     err,
+			}).Warn("Error killing command")
+		}
+		<-done
+		killedErr := fmt.Errorf("%s killed: %v: %s", config.Command, ctx.Err(), strings.TrimSpace(stderr.String()))
+		if event.Context().Err() != nil {
+			return nil, events.Permanent(killedErr).WithCode("execKilled", nil)
+		}
+		return nil, events.Retryable(killedErr).WithCode("execTimeout", nil)
+	}
+}
+
+// limitBuffer keeps the first max bytes written to it, and records whether more were written.
+// It takes everything written to it, so that the command isn't stopped by a broken pipe.
+type limitBuffer struct {
+	max        int
+	buf        []byte
+	overflowed bool
+}
+
+func (b *limitBuffer) Write(p []byte) (int, error) {
+	kept := p
+	if room := b.max - len(b.buf); len(p) > room {
+		b.overflowed = true
+		kept = p[:room]
+	}
+	b.buf = append(b.buf, kept...)
+	return len(p), nil
+}
+
+func (b *limitBuffer) Bytes() []byte {
+	return b.buf
+}
+
+// tailBuffer keeps the last max bytes written to it.
+type tailBuffer struct {
+	max int
+	buf []byte
+}
+
+func (b *tailBuffer) Write(p []byte) (int, error) {
+	b.buf = append(b.buf, p...)
+	if len(b.buf) > b.max {
+		b.buf = b.buf[len(b.buf)-b.max:]
+	}
+	return len(p), nil
+}
+
+func (b *tailBuffer) String() string {
+	return string(b.buf)
+}
@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/chenleji/event-subscriber/events"
+)
+
+func shell(script string) ExecConfig {
+	return ExecConfig{Command: "/bin/sh", Args: []string{"-c", script}}
+}
+
+func TestExecReply(t *testing.T) {
+	handler := Exec(shell(`read input; echo "{\"name\": \"$EVENT_NAME\", \"resource\": \"$RESOURCE_ID\", \"input\": $input}"`))
+	event := &events.Event{Name: "instance.start", ID: "1", ResourceID: "1i1", ReplyTo: "reply.1"}
+	if err := handler(event, nil); err != nil {
+		t.Fatal(err)
+	}
+	data := event.Reply().Data
+	if data["name"] != "instance.start" || data["resource"] != "1i1" || data["input"].(map[string]interface{})["id"] != "1" {
+		t.Errorf("Unexpected reply data %v", data)
+	}
+}
+
+func TestExecFailure(t *testing.T) {
+	handler := Exec(shell(`echo "lots of output" >&2; echo "disk full" >&2; exit 3`))
+	err := handler(&events.Event{Name: "instance.start"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "disk full") {
+		t.Fatalf("Expected the stderr tail in the error, got %v", err)
+	}
+
+	config := shell(`echo "lots of output" >&2; echo "disk full" >&2; exit 3`)
+	config.StderrTail = 10
+	err = Exec(config)(&events.Event{Name: "instance.start"}, nil)
+	if err == nil || strings.Contains(err.Error(), "lots") || !strings.Contains(err.Error(), "disk full") {
+		t.Errorf("Expected only the end of stderr in the error, got %v", err)
+	}
+}
+
+func TestExecMaxStdout(t *testing.T) {
+	config := shell(`head -c 2000 /dev/zero`)
+	config.MaxStdout = 1000
+	err := Exec(config)(&events.Event{Name: "instance.start"}, nil)
+	if err == nil || !strings.Contains(err.Error(), "more than 1000 bytes") {
+		t.Errorf("Expected too much output to fail the event, got %v", err)
+	}
+}
+
+func TestExecTimeoutKillsProcessGroup(t *testing.T) {
+	// The shell waits for a child, which must be killed too for the handler to return.
+	config := shell(`sleep 10 & wait`)
+	config.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	err := Exec(config)(&events.Event{Name: "instance.start"}, nil)
+	if handlerErr, ok := events.AsHandlerError(err); !ok || handlerErr.Kind != events.ErrorRetryable {
+		t.Errorf("Expected a retryable error from a command that timed out, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the command to be killed at the timeout, took %v", elapsed)
+	}
+}
+
+func TestExecMaxConcurrent(t *testing.T) {
+	config := shell(`sleep 0.1`)
+	config.MaxConcurrent = 1
+	// Handlers for two routes that run the same command share its limit.
+	routes := []events.EventHandler{Exec(config), Exec(config)}
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := routes[i%2](&events.Event{Name: "instance.start"}, nil); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if elapsed := time.Since(start); elapsed < 300*time.Millisecond {
+		t.Errorf("Expected the commands to run one at a time, took %v", elapsed)
+	}
+}
@@ -0,0 +1,12 @@
+package handlers
+
+import (
+	"os/exec"
+)
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+// killProcessGroup kills only the command itself, since Windows has no process groups to signal.
+func killProcessGroup(cmd *exec.Cmd) error {
+	return cmd.Process.Kill()
+}
@@ -0,0 +1,142 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/chenleji/event-subscriber/client"
+	"github.com/chenleji/event-subscriber/events"
+)
+
+const (
+	// DefaultSignatureHeader carries the HMAC-SHA256 of the request body, as "sha256=<hex>".
+	DefaultSignatureHeader = "X-Event-Signature"
+	// DefaultWebhookTimeout limits each request when WebhookConfig.Timeout is zero.
+	DefaultWebhookTimeout = 10 * time.Second
+)
+
+// WebhookConfig describes an HTTP endpoint that handles events.
+type WebhookConfig struct {
+	URL string
+	// Secret is the key the request body is signed with. If empty, requests are not signed.
+	Secret          string
+	SignatureHeader string
+	Headers         map[string]string
+	// Timeout limits each attempt. If zero, DefaultWebhookTimeout.
+	Timeout time.Duration
+	// Retry retries failed attempts: connection errors and 5xx responses. The zero value makes
+	// a single attempt.
+	Retry  events.RetryPolicy
+	Client *http.Client
+}
+
+// Webhook returns a handler that POSTs each event's JSON to the configured URL. The name and ID
+// of the event are also sent in the X-Event-Name and X-Event-Id headers. The body of a 2xx
+// response with a JSON Content-Type must be a JSON object, which becomes the Data of the reply;
+// other 2xx bodies are ignored. Any other status fails the event with the response formatted as
+// a client.ApiError.
+func Webhook(config WebhookConfig) events.EventHandler {
+	if config.SignatureHeader == "" {
+		config.SignatureHeader = DefaultSignatureHeader
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = DefaultWebhookTimeout
+	}
+	if config.Client == nil {
+		config.Client = http.DefaultClient
+	}
+
+	handler := events.Replying(func(event *events.Event, apiClient *client.GenericClient) (*events.ReplyEvent, error) {
+		body, contentType, err := postEvent(config, event)
+		if err != nil {
+			return nil, err
+		}
+
+		reply := events.NewReplyEvent(event.ReplyTo, event.ID)
+		body = bytes.TrimSpace(body)
+		if len(body) > 0 && isJSON(contentType) {
+			if err := json.Unmarshal(body, &reply.Data); err != nil {
+				return nil, events.Permanent(fmt.Errorf("%s responded with invalid reply data: %v", config.URL, err))
+			}
+		}
+		return reply, nil
+	})
+	if config.Retry.MaxAttempts > 1 {
+		handler = events.Chain(handler, events.Retry(config.Retry))
+	}
+	return handler
+}
+
+// isJSON reports whether contentType is application/json or a JSON based type such as
+// application/vnd.api+json.
+func isJSON(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// postEvent sends the event and returns the body and Content-Type of a 2xx response.
+func postEvent(config WebhookConfig, event *events.Event) ([]byte, string, error) {
+	payload := []byte(event.Raw())
+	if payload == nil {
+		var err error
+		if payload, err = json.Marshal(event); err != nil {
+			return nil, "", err
+		}
+	}
+
+	req, err := http.NewRequest("POST", config.URL, bytes.NewReader(payload))
+	if err != nil {
+		return nil, "", events.Permanent(err)
+	}
+	ctx, cancel := context.WithTimeout(event.Context(), config.Timeout)
+	defer cancel()
+	req = req.WithContext(ctx)
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Name", event.Name)
+	req.Header.Set("X-Event-Id", event.ID)
+	for name, value := range config.Headers {
+		req.Header.Set(name, value)
+	}
+	if config.Secret != "" {
+		req.Header.Set(config.SignatureHeader, Sign(config.Secret, payload))
+	}
+
+	resp, err := config.Client.Do(req)
+	if err != nil {
+		return nil, "", events.Retryable(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		apiErr := client.NewApiError(resp, config.URL)
+		data := map[string]interface{}{
+			"statusCode": apiErr.StatusCode,
+			"body":       apiErr.Body,
+		}
+		if apiErr.StatusCode >= 500 {
+			return nil, "", events.Retryable(apiErr).WithCode("webhookFailed", data)
+		}
+		return nil, "", events.Permanent(apiErr).WithCode("webhookFailed", data)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, resp.Header.Get("Content-Type"), err
+}
+
+// Sign returns the signature header value for body: "sha256=" and the hex HMAC-SHA256 of body
+// keyed with secret. Receivers should compare it with hmac.Equal.
+func Sign(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/chenleji/event-subscriber/events"
+)
+
+func TestWebhookReply(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, _ := ioutil.ReadAll(req.Body)
+		if req.Header.Get(DefaultSignatureHeader) != Sign("s3cret", body) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if req.Header.Get("X-Event-Name") == "instance.stop" {
+			w.Write([]byte("OK"))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write([]byte(`{"handled": "` + req.Header.Get("X-Event-Name") + `"}`))
+	}))
+	defer server.Close()
+
+	handler := Webhook(WebhookConfig{URL: server.URL, Secret: "s3cret"})
+	event := &events.Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+	if err := handler(event, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data := event.Reply().Data; data["handled"] != "instance.start" {
+		t.Errorf("Unexpected reply data %v", data)
+	}
+
+	event = &events.Event{Name: "instance.stop", ID: "2", ReplyTo: "reply.2"}
+	if err := handler(event, nil); err != nil {
+		t.Fatalf("Expected a text body to be ignored, got %v", err)
+	}
+	if data := event.Reply().Data; len(data) != 0 {
+		t.Errorf("Expected empty reply data for a text body, got %v", data)
+	}
+}
+
+func TestWebhookRetry(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer server.Close()
+
+	handler := Webhook(WebhookConfig{
+		URL:   server.URL,
+		Retry: events.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2},
+	})
+	event := &events.Event{Name: "instance.start", ID: "1", ReplyTo: "reply.1"}
+	if err := handler(event, nil); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || event.Reply() == nil {
+		t.Errorf("Expected a reply after 3 attempts, got %v attempts", calls)
+	}
+}
+
+func TestWebhookError(t *testing.T) {
+	var calls int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(`{"message": "unknown instance"}`))
+	}))
+	defer server.Close()
+
+	handler := Webhook(WebhookConfig{
+		URL:   server.URL,
+		Retry: events.RetryPolicy{MaxAttempts: 3, InitialBackoff: time.Millisecond, Multiplier: 2},
+	})
+	err := handler(&events.Event{Name: "instance.start"}, nil)
+	handlerErr, ok := err.(*events.HandlerError)
+	if !ok || handlerErr.Kind != events.ErrorPermanent || !strings.Contains(err.Error(), "message=unknown instance") {
+		t.Fatalf("Expected a permanent error carrying the body, got %v", err)
+	}
+	if handlerErr.Data["statusCode"] != http.StatusBadRequest || calls != 1 {
+		t.Errorf("Expected a single attempt and the status in the reply data, got %v and %v", handlerErr.Data, calls)
+	}
+}
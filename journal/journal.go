@@ -0,0 +1,440 @@
+// Package journal records the events a subscriber receives, as it receives them, and
+// what became of them to a JSON Lines file so that an incident can be reconstructed later.
+package journal
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/events"
+)
+
+// Outcome says what the router did with a recorded event.
+type Outcome string
+
+const (
+	// Received is written as soon as an event is read, before it has an outcome, so that events
+	// still running or waiting when the process dies are recorded too.
+	Received         Outcome = "received"
+	Handled          Outcome = "handled"
+	Failed           Outcome = "error"
+	Ignored          Outcome = "ignored"
+	Requeued         Outcome = "requeued"
+	DroppedNoWorker  Outcome = "dropped-no-worker"
+	DroppedQueue     Outcome = "dropped-queue-full"
+	DroppedLocked    Outcome = "dropped-locked"
+	DroppedDraining  Outcome = "dropped-draining"
+	DroppedCollapsed Outcome = "dropped-collapsed"
+	NoHandler        Outcome = "no-handler"
+	// Malformed is a message from the event stream that could not be parsed as an event.
+	Malformed Outcome = "malformed"
+)
+
+var dropOutcomes = map[events.DropReason]Outcome{
+	events.DropNoWorker:  DroppedNoWorker,
+	events.DropQueueFull: DroppedQueue,
+	events.DropLocked:    DroppedLocked,
+	events.DropDraining:  DroppedDraining,
+	events.DropCollapsed: DroppedCollapsed,
+	events.DropNoHandler: NoHandler,
+}
+
+// Entry is one line of the journal.
+type Entry struct {
+	ReceivedAt     time.Time       `json:"receivedAt"`
+	RecordedAt     time.Time       `json:"recordedAt"`
+	Outcome        Outcome         `json:"outcome"`
+	Error          string          `json:"error,omitempty"`
+	DurationMillis float64         `json:"durationMillis,omitempty"`
+	Event          json.RawMessage `json:"event"`
+	// Message is the raw text of a Malformed message. Since it can't be parsed, the values of
+	// redacted keys are found by matching "key": value pairs anywhere in it.
+	Message string `json:"message,omitempty"`
+}
+
+// Defaults for the Config fields that bound how many events wait for an outcome.
+const (
+	DefaultMaxPending = 10000
+	DefaultPendingTTL = time.Hour
+)
+
+// rotatedLayout is the layout of the timestamp suffix of rotated files.
+const rotatedLayout = "20060102T150405.000000000"
+
+// Redacted replaces the value of redacted keys.
+const Redacted = "[REDACTED]"
+
+// DefaultRedactKeys are the keys of event Data whose values are redacted unless Config says otherwise.
+var DefaultRedactKeys = []string{"password", "secret", "secretKey", "token", "privateKey", "accessKey"}
+
+// Config says where a Recorder writes and what it leaves out.
+type Config struct {
+	// Path is the file the journal is appended to. Rotated files get a timestamp suffix.
+	Path string
+	// MaxSize rotates the file before it grows beyond this many bytes. Zero means no limit.
+	MaxSize int64
+	// MaxAge rotates the file once it has been written to for this long. Zero means no limit.
+	MaxAge time.Duration
+	// MaxBackups is how many rotated files are kept. Zero keeps them all.
+	MaxBackups int
+	// RedactKeys are matched, ignoring case, against keys at any depth of event Data. If nil,
+	// DefaultRedactKeys are used.
+	RedactKeys []string
+	// MaxPending is how many events the Recorder remembers the receive time of while they wait
+	// for an outcome. The oldest are forgotten beyond it. If zero, DefaultMaxPending is used.
+	MaxPending int
+	// PendingTTL is how long the receive time of an event without an outcome is remembered.
+	// If zero, DefaultPendingTTL is used.
+	PendingTTL time.Duration
+}
+
+// Recorder is an events.Observer that writes an Entry for every event the router receives,
+// another for every outcome of it, and one for every message it could not parse. Register it
+// with EventRouter.AddObserver.
+type Recorder struct {
+	events.NopObserver
+	config     Config
+	redactKeys map[string]bool
+	// redactPairs matches "key": value pairs of redacted keys in text that isn't valid JSON.
+	redactPairs *regexp.Regexp
+
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+	opened   time.Time
+	received map[*events.Event]time.Time
+	swept    time.Time
+}
+
+func NewRecorder(config Config) (*Recorder, error) {
+	if config.RedactKeys == nil {
+		config.RedactKeys = DefaultRedactKeys
+	}
+	if config.MaxPending <= 0 {
+		config.MaxPending = DefaultMaxPending
+	}
+	if config.PendingTTL <= 0 {
+		config.PendingTTL = DefaultPendingTTL
+	}
+	r := &Recorder{
+		config:     config,
+		redactKeys: map[string]bool{},
+		received:   map[*events.Event]time.Time{},
+	}
+	var quoted []string
+	for _, key := range config.RedactKeys {
+		r.redactKeys[strings.ToLower(key)] = true
+		quoted = append(quoted, regexp.QuoteMeta(key))
+	}
+	if len(quoted) > 0 {
+		// The value is a string, possibly cut short, or anything else up to the next delimiter.
+		r.redactPairs = regexp.MustCompile(`(?i)("(?:` + strings.Join(quoted, "|") + `)"\s*:\s*)("(?:[^"\\]|\\.)*"?|[^,}\]\s]*)`)
+	}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close closes the journal file.
+func (r *Recorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.file == nil {
+		return nil
+	}
+	err := r.file.Close()
+	r.file = nil
+	return err
+}
+
+func (r *Recorder) EventReceived(event *events.Event) {
+	raw := r.redact(event)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	now := time.Now()
+	r.writeLocked(Entry{
+		ReceivedAt: now,
+		RecordedAt: now,
+		Outcome:    Received,
+		Event:      raw,
+	})
+	r.received[event] = now
+	if len(r.received) > r.config.MaxPending || now.Sub(r.swept) > r.config.PendingTTL/10 {
+		r.sweep(now)
+	}
+}
+
+// sweep forgets the receive times of events that have waited longer than PendingTTL for an
+// outcome, then the oldest ones beyond MaxPending, so that events whose outcome never comes
+// don't pile up. Their outcomes, if any, are recorded without a receive time.
+func (r *Recorder) sweep(now time.Time) {
+	r.swept = now
+	type pending struct {
+		event      *events.Event
+		receivedAt time.Time
+	}
+	var kept []pending
+	for event, receivedAt := range r.received {
+		if now.Sub(receivedAt) > r.config.PendingTTL {
+			delete(r.received, event)
+		} else {
+			kept = append(kept, pending{event, receivedAt})
+		}
+	}
+	if excess := len(kept) - r.config.MaxPending; excess > 0 {
+		sort.Slice(kept, func(i, j int) bool {
+			return kept[i].receivedAt.Before(kept[j].receivedAt)
+		})
+		for _, p := range kept[:excess] {
+			delete(r.received, p.event)
+		}
+	}
+}
+
+func (r *Recorder) EventDropped(event *events.Event, reason events.DropReason) {
+	r.record(event, Entry{Outcome: DropOutcome(reason)}, true)
+}
+
+func (r *Recorder) HandlerFinished(event *events.Event, duration time.Duration, err error) {
+	entry := Entry{
+		Outcome:        HandlerOutcome(err),
+		DurationMillis: float64(duration) / float64(time.Millisecond),
+	}
+	if err != nil {
+		entry.Error = err.Error()
+	}
+	// A requeued event comes back, so keep its receive time for the next outcome.
+	r.record(event, entry, entry.Outcome != Requeued)
+}
+
+func (r *Recorder) MessageMalformed(message []byte, err error) {
+	now := time.Now()
+	r.write(Entry{
+		ReceivedAt: now,
+		RecordedAt: now,
+		Outcome:    Malformed,
+		Error:      err.Error(),
+		Message:    r.redactMessage(message),
+	})
+}
+
+// DropOutcome returns the outcome of an event dropped for reason.
+func DropOutcome(reason events.DropReason) Outcome {
+	if outcome, ok := dropOutcomes[reason]; ok {
+		return outcome
+	}
+	return Outcome("dropped-" + string(reason))
+}
+
+// HandlerOutcome returns the outcome of a handler call that returned err.
+func HandlerOutcome(err error) Outcome {
+	if err == nil {
+		return Handled
+	}
+	if handlerErr, ok := events.AsHandlerError(err); ok {
+		switch handlerErr.Kind {
+		case events.ErrorIgnore:
+			return Ignored
+		case events.ErrorRequeue:
+			return Requeued
+		}
+	}
+	return Failed
+}
+
+func (r *Recorder) record(event *events.Event, entry Entry, done bool) {
+	entry.RecordedAt = time.Now()
+	entry.Event = r.redact(event)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	entry.ReceivedAt = r.received[event]
+	if done {
+		delete(r.received, event)
+	}
+	r.writeLocked(entry)
+}
+
+func (r *Recorder) write(entry Entry) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.writeLocked(entry)
+}
+
+func (r *Recorder) writeLocked(entry Entry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"outcome": entry.Outcome,
+			"err":     err,
+		}).Warn("Error encoding journal entry")
+		return
+	}
+	line = append(line, '\n')
+
+	if r.file != nil && r.needsRotation(int64(len(line))) {
+		if err := r.rotate(); err != nil {
+			log.WithFields(log.Fields{
+				"path": r.config.Path,
+				"err":  err,
+			}).Warn("Error rotating journal")
+		}
+	}
+	if r.file == nil {
+		// A failed rotation left no file open; try again rather than stop journaling.
+		if err := r.open(); err != nil {
+			log.WithFields(log.Fields{
+				"path": r.config.Path,
+				"err":  err,
+			}).Warn("Error opening journal")
+			return
+		}
+	}
+	n, err := r.file.Write(line)
+	r.size += int64(n)
+	if err != nil {
+		log.WithFields(log.Fields{
+			"path": r.config.Path,
+			"err":  err,
+		}).Warn("Error writing journal entry")
+	}
+}
+
+// redact returns the event's raw message, or its encoding if there is none, with redacted
+// keys of its Data replaced.
+func (r *Recorder) redact(event *events.Event) json.RawMessage {
+	raw := []byte(event.Raw())
+	if raw == nil {
+		var err error
+		if raw, err = json.Marshal(event); err != nil {
+			return json.RawMessage("null")
+		}
+	}
+	if len(r.redactKeys) == 0 {
+		return raw
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.UseNumber()
+	var message map[string]interface{}
+	if err := decoder.Decode(&message); err != nil {
+		return raw
+	}
+	if data, ok := message["data"]; ok {
+		message["data"] = r.redactValue(data)
+	}
+	redacted, err := json.Marshal(message)
+	if err != nil {
+		return raw
+	}
+	return redacted
+}
+
+// redactMessage returns message with the values of redacted keys replaced wherever they appear.
+func (r *Recorder) redactMessage(message []byte) string {
+	if r.redactPairs == nil {
+		return string(message)
+	}
+	return string(r.redactPairs.ReplaceAll(message, []byte(`${1}"`+Redacted+`"`)))
+}
+
+func (r *Recorder) redactValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for key, inner := range v {
+			if r.redactKeys[strings.ToLower(key)] {
+				v[key] = Redacted
+			} else {
+				v[key] = r.redactValue(inner)
+			}
+		}
+	case []interface{}:
+		for i, inner := range v {
+			v[i] = r.redactValue(inner)
+		}
+	}
+	return value
+}
+
+func (r *Recorder) needsRotation(next int64) bool {
+	if r.config.MaxSize > 0 && r.size > 0 && r.size+next > r.config.MaxSize {
+		return true
+	}
+	return r.config.MaxAge > 0 && time.Since(r.opened) > r.config.MaxAge
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.config.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	r.file = file
+	r.size = info.Size()
+	r.opened = time.Now()
+	return nil
+}
+
+// rotate renames the current file aside and opens a new one. If no file could be opened,
+// r.file is left nil and the next write tries again.
+func (r *Recorder) rotate() error {
+	err := r.file.Close()
+	r.file = nil
+	if err != nil {
+		return err
+	}
+	rotated := r.config.Path + "." + time.Now().UTC().Format(rotatedLayout)
+	if err := os.Rename(r.config.Path, rotated); err != nil {
+		// Keep appending to the current file rather than lose entries.
+		if openErr := r.open(); openErr != nil {
+			return openErr
+		}
+		return err
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	return r.prune()
+}
+
+// prune removes the oldest rotated files beyond MaxBackups. Other files that start with the
+// journal's name, such as compressed copies, are left alone.
+func (r *Recorder) prune() error {
+	if r.config.MaxBackups <= 0 {
+		return nil
+	}
+	matches, err := filepath.Glob(r.config.Path + ".*")
+	if err != nil {
+		return err
+	}
+	var backups []string
+	for _, match := range matches {
+		suffix := strings.TrimPrefix(match, r.config.Path+".")
+		if _, err := time.Parse(rotatedLayout, suffix); err == nil {
+			backups = append(backups, match)
+		}
+	}
+	// The timestamp suffix sorts in time order.
+	sort.Strings(backups)
+	for len(backups) > r.config.MaxBackups {
+		if err := os.Remove(backups[0]); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
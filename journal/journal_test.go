@@ -0,0 +1,231 @@
+package journal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chenleji/event-subscriber/events"
+)
+
+func readEntries(t *testing.T, path string) []Entry {
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entry := Entry{}
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			t.Fatal(err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestRecorder(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	recorder, err := NewRecorder(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	handled := &events.Event{Name: "instance.start", ID: "1", Data: map[string]interface{}{
+		"instance": map[string]interface{}{"name": "web", "Password": "hunter2"},
+	}}
+	failed := &events.Event{Name: "instance.stop", ID: "2"}
+	dropped := &events.Event{Name: "instance.stop", ID: "3"}
+	for _, event := range []*events.Event{handled, failed, dropped} {
+		recorder.EventReceived(event)
+	}
+	if entries := readEntries(t, path); len(entries) != 3 || entries[2].Outcome != Received {
+		t.Fatalf("Expected 3 received entries before any outcome, got %+v", entries)
+	}
+	recorder.HandlerFinished(handled, 20*time.Millisecond, nil)
+	recorder.HandlerFinished(failed, time.Millisecond, errors.New("failed"))
+	recorder.EventDropped(dropped, events.DropLocked)
+
+	entries := readEntries(t, path)
+	if len(entries) != 6 {
+		t.Fatalf("Expected 6 entries, got %v", len(entries))
+	}
+	entries = entries[3:]
+	for i, outcome := range []Outcome{Handled, Failed, DroppedLocked} {
+		if entries[i].Outcome != outcome || entries[i].ReceivedAt.IsZero() {
+			t.Errorf("Expected entry %v to be %v with a receive time, got %+v", i, outcome, entries[i])
+		}
+	}
+	if entries[0].DurationMillis != 20 || entries[1].Error != "failed" {
+		t.Errorf("Unexpected duration or error: %+v %+v", entries[0], entries[1])
+	}
+
+	event := &events.Event{}
+	if err := json.Unmarshal(entries[0].Event, event); err != nil {
+		t.Fatal(err)
+	}
+	instance := event.Data["instance"].(map[string]interface{})
+	if instance["Password"] != Redacted || instance["name"] != "web" {
+		t.Errorf("Expected only the password to be redacted, got %v", instance)
+	}
+	if handled.Data["instance"].(map[string]interface{})["Password"] != "hunter2" {
+		t.Error("Expected redaction to leave the event itself alone")
+	}
+}
+
+func TestRecorderRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	recorder, err := NewRecorder(Config{Path: path, MaxSize: 300, MaxBackups: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	for _, other := range []string{path + ".gz", path + ".bak"} {
+		if err := ioutil.WriteFile(other, nil, 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 10; i++ {
+		event := &events.Event{Name: "instance.start", ID: strings.Repeat("x", 100)}
+		recorder.HandlerFinished(event, time.Millisecond, nil)
+	}
+
+	backups, _ := filepath.Glob(path + ".2*")
+	if len(backups) != 2 {
+		t.Errorf("Expected 2 rotated files, got %v", backups)
+	}
+	if others, _ := filepath.Glob(path + ".[gb]*"); len(others) != 2 {
+		t.Errorf("Expected files that weren't rotated to be kept, got %v", others)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() > 300 {
+		t.Errorf("Expected the current file to stay under the size limit, got %v %v", info, err)
+	}
+}
+
+func TestRecorderRotationRecovers(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("Permissions don't apply to root")
+	}
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	recorder, err := NewRecorder(Config{Path: path, MaxSize: 300})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	event := &events.Event{Name: "instance.start", ID: strings.Repeat("x", 100)}
+	recorder.HandlerFinished(event, time.Millisecond, nil)
+
+	// With the file gone and the directory unwritable, rotation can neither rename nor reopen it.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(dir, 0500); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		recorder.HandlerFinished(event, time.Millisecond, nil)
+	}
+	if err := os.Chmod(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	recorder.HandlerFinished(event, time.Millisecond, nil)
+	if entries := readEntries(t, path); len(entries) != 1 {
+		t.Fatalf("Expected the journal to be reopened with 1 entry, got %v", len(entries))
+	}
+}
+
+func TestRecorderPending(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	recorder, err := NewRecorder(Config{Path: path, MaxPending: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	received := []*events.Event{}
+	for i := 0; i < 5; i++ {
+		event := &events.Event{Name: "instance.start", ID: strconv.Itoa(i)}
+		recorder.EventReceived(event)
+		received = append(received, event)
+		time.Sleep(time.Millisecond)
+	}
+	if pending := len(recorder.received); pending != 2 {
+		t.Errorf("Expected 2 pending events, got %v", pending)
+	}
+
+	recorder.EventDropped(received[0], events.DropCollapsed)
+	recorder.EventDropped(received[4], events.DropCollapsed)
+	entries := readEntries(t, path)
+	if len(entries) != 7 {
+		t.Fatalf("Expected 5 received and 2 collapsed entries, got %+v", entries)
+	}
+	entries = entries[5:]
+	if entries[0].Outcome != DroppedCollapsed {
+		t.Fatalf("Expected 2 collapsed entries, got %+v", entries)
+	}
+	if !entries[0].ReceivedAt.IsZero() || entries[1].ReceivedAt.IsZero() {
+		t.Errorf("Expected only the newest event to keep its receive time, got %+v", entries)
+	}
+}
+
+func TestRecorderMalformed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "journal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "events.jsonl")
+
+	recorder, err := NewRecorder(Config{Path: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer recorder.Close()
+
+	recorder.MessageMalformed([]byte(`{"name": `), errors.New("unexpected end of JSON input"))
+	recorder.MessageMalformed([]byte(`{"data": {"SecretKey": "s3\"cret", "token": 42, "accessKey": "AK`), errors.New("unexpected end of JSON input"))
+	entries := readEntries(t, path)
+	if len(entries) != 2 || entries[0].Outcome != Malformed || entries[0].Message != `{"name": ` || entries[0].Error == "" {
+		t.Fatalf("Expected the malformed messages to be recorded, got %+v", entries)
+	}
+	if message := entries[1].Message; message != `{"data": {"SecretKey": "[REDACTED]", "token": "[REDACTED]", "accessKey": "[REDACTED]"` {
+		t.Errorf("Expected the secrets of the malformed message to be redacted, got %v", message)
+	}
+}
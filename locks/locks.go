@@ -1,7 +1,14 @@
 package locks
 
+import "sync/atomic"
+
 var lockRequests = make(chan *lockRequest)
 
+var (
+	heldCount       int64
+	contentionCount uint64
+)
+
 func init() {
 	go locker()
 }
@@ -96,13 +103,26 @@ func locker() {
 		switch lockReq.op {
 		case LOCK:
 			if _, locked := lockedItems[lockReq.key]; locked {
+				atomic.AddUint64(&contentionCount, 1)
 				lockReq.response <- nil
 			} else {
 				lockedItems[lockReq.key] = true
+				atomic.StoreInt64(&heldCount, int64(len(lockedItems)))
 				lockReq.response <- newUnlocker(lockReq.key)
 			}
 		case UNLOCK:
 			delete(lockedItems, lockReq.key)
+			atomic.StoreInt64(&heldCount, int64(len(lockedItems)))
 		}
 	}
 }
+
+// Held returns the number of keys currently locked through KeyLocker.
+func Held() int64 {
+	return atomic.LoadInt64(&heldCount)
+}
+
+// Contentions returns how many times KeyLocker failed to lock a key because it was already held.
+func Contentions() uint64 {
+	return atomic.LoadUint64(&contentionCount)
+}
@@ -6,21 +6,40 @@ import (
 )
 
 func TestLock(t *testing.T) {
+	// The counters are shared by every lock in the process, so only their changes are checked.
+	contentions := Contentions()
 
 	unlocker := KeyLocker("foo1").Lock()
 	if unlocker == nil {
-		t.Errorf("Didn't obtain lock")
+		t.Fatal("Didn't obtain lock")
 	}
+	// Unlock doesn't wait for the count to drop, but Lock does wait for it to rise, so the held
+	// count is read once this lock is taken.
+	held := Held()
 
 	unlocker2 := KeyLocker("foo1").Lock()
 	if unlocker2 != nil {
 		t.Error("Did obtain lock")
 	}
 
+	if Contentions() != contentions+1 {
+		t.Errorf("Expected the failed lock to be counted, got %v contentions from %v", Contentions(), contentions)
+	}
+
 	unlocker.Unlock()
 	unlocker = KeyLocker("foo1").Lock()
 	if unlocker == nil {
-		t.Errorf("Didn't obtain lock")
+		t.Fatal("Didn't obtain lock")
+	}
+	defer unlocker.Unlock()
+
+	unlocker2 = KeyLocker("foo2").Lock()
+	if unlocker2 == nil {
+		t.Fatal("Didn't obtain lock")
+	}
+	defer unlocker2.Unlock()
+	if Held() != held+1 {
+		t.Errorf("Unexpected held count %v from %v", Held(), held)
 	}
 
 }
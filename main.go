@@ -1,12 +1,47 @@
 package main
 
 import (
-	"github.com/Sirupsen/logrus"
+	"flag"
+	"fmt"
+	"os"
 
-	// Import just so that doing a build from root will compile the important parts
-	_ "github.com/chenleji/event-subscriber/events"
+	"github.com/Sirupsen/logrus"
 )
 
+// VERSION is set by scripts/build.
+var VERSION = "dev"
+
+const usage = `Usage: event-subscriber <command> [flags]
+
+Commands:
+  run      subscribe to Cattle events and handle them
+  replay   replay a file of recorded events offline
+  version  print the version
+
+Run "event-subscriber <command> -h" for the flags of a command.
+`
+
 func main() {
-	logrus.Info("Executing main.")
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "run":
+		err = runCommand(os.Args[2:])
+	case "replay":
+		err = replayCommand(os.Args[2:])
+	case "version":
+		fmt.Println(VERSION)
+	case "-h", "-help", "--help", "help":
+		fmt.Print(usage)
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown command %q\n\n%s", os.Args[1], usage)
+		os.Exit(2)
+	}
+	if err != nil && err != flag.ErrHelp {
+		logrus.Fatal(err)
+	}
 }
@@ -0,0 +1,142 @@
+package metrics
+
+import (
+	"bytes"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/events"
+	"github.com/chenleji/event-subscriber/locks"
+)
+
+// Collector records metrics about an EventRouter. Register it with
+// EventRouter.AddObserver and serve it over HTTP.
+type Collector struct {
+	received        *counterVec
+	dropped         *counterVec
+	handlerErrors   *counterVec
+	abandoned       *counterVec
+	publishFailures *counterVec
+	reconnects      *counterVec
+	malformed       *counterVec
+	latency         *histogramVec
+	inFlight        int64
+
+	mu       sync.Mutex
+	lastPong time.Time
+}
+
+func NewCollector() *Collector {
+	return &Collector{
+		received:        newCounterVec("event_subscriber_events_received_total", "Events received, by event name.", "event"),
+		dropped:         newCounterVec("event_subscriber_events_dropped_total", "Events that were not handled, by event name and reason.", "event", "reason"),
+		handlerErrors:   newCounterVec("event_subscriber_handler_errors_total", "Handler calls that failed, by event name. Ignored and requeued events are not failures.", "event"),
+		abandoned:       newCounterVec("event_subscriber_handlers_abandoned_total", "Handlers abandoned after running well past their timeout, by event name. Each one leaks a goroutine.", "event"),
+		publishFailures: newCounterVec("event_subscriber_publish_failures_total", "Replies and progress updates that could not be published."),
+		reconnects:      newCounterVec("event_subscriber_websocket_reconnects_total", "Times the event stream was re-established after being lost."),
+		malformed:       newCounterVec("event_subscriber_malformed_messages_total", "Messages from the event stream that could not be parsed."),
+		latency:         newHistogramVec("event_subscriber_handler_duration_seconds", "Handler latency, by event name.", DefaultBuckets, "event"),
+	}
+}
+
+// eventName strips the handler suffix so that label values stay few.
+func eventName(event *events.Event) string {
+	return strings.SplitN(event.Name, ";", 2)[0]
+}
+
+func (c *Collector) EventReceived(event *events.Event) {
+	c.received.inc(eventName(event))
+}
+
+func (c *Collector) EventDropped(event *events.Event, reason events.DropReason) {
+	c.dropped.inc(eventName(event), string(reason))
+}
+
+func (c *Collector) HandlerStarted(event *events.Event) {
+	atomic.AddInt64(&c.inFlight, 1)
+}
+
+func (c *Collector) HandlerFinished(event *events.Event, duration time.Duration, err error) {
+	atomic.AddInt64(&c.inFlight, -1)
+	c.latency.observe(duration.Seconds(), eventName(event))
+	if failed(err) {
+		c.handlerErrors.inc(eventName(event))
+	}
+}
+
+// failed reports whether err is a failure rather than a handler skipping or requeueing the event.
+func failed(err error) bool {
+	if err == nil {
+		return false
+	}
+	if handlerErr, ok := events.AsHandlerError(err); ok {
+		return handlerErr.Kind != events.ErrorIgnore && handlerErr.Kind != events.ErrorRequeue
+	}
+	return true
+}
+
+func (c *Collector) HandlerAbandoned(event *events.Event) {
+	c.abandoned.inc(eventName(event))
+}
+
+func (c *Collector) PublishFailed(event *events.Event, err error) {
+	c.publishFailures.inc()
+}
+
+func (c *Collector) Reconnected() {
+	c.reconnects.inc()
+}
+
+func (c *Collector) MessageMalformed(message []byte, err error) {
+	c.malformed.inc()
+}
+
+func (c *Collector) PongReceived() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lastPong = time.Now()
+}
+
+// ServeHTTP writes the metrics in the Prometheus text format.
+func (c *Collector) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	buf := &bytes.Buffer{}
+	c.received.write(buf)
+	c.dropped.write(buf)
+	c.handlerErrors.write(buf)
+	c.abandoned.write(buf)
+	c.publishFailures.write(buf)
+	c.reconnects.write(buf)
+	c.malformed.write(buf)
+	c.latency.write(buf)
+	writeGauge(buf, "event_subscriber_handlers_in_flight", "Handlers currently running.", float64(atomic.LoadInt64(&c.inFlight)))
+
+	c.mu.Lock()
+	lastPong := c.lastPong
+	c.mu.Unlock()
+	if !lastPong.IsZero() {
+		writeGauge(buf, "event_subscriber_seconds_since_last_pong", "Seconds since the last websocket pong.", time.Since(lastPong).Seconds())
+	}
+
+	writeGauge(buf, "event_subscriber_locks_held", "Resource locks currently held, by the resourceId and ordered lockers.", float64(locks.Held()+events.OrderedLocksHeld()))
+	writeGauge(buf, "event_subscriber_events_parked", "Events waiting in an ordered locker for their resource to be unlocked.", float64(events.OrderedLocksParked()))
+	contentions := locks.Contentions() + events.OrderedLockContentions()
+	writeHeader(buf, "event_subscriber_lock_contentions_total", "Events that found their resource already locked, and were dropped or, by an ordered locker, parked.", "counter")
+	buf.WriteString("event_subscriber_lock_contentions_total " + formatValue(float64(contentions)) + "\n")
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// ListenAndServe serves the metrics at /metrics on addr, for example "localhost:9108".
+func (c *Collector) ListenAndServe(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", c)
+	log.WithFields(log.Fields{
+		"addr": addr,
+	}).Info("Serving metrics")
+	return http.ListenAndServe(addr, mux)
+}
@@ -0,0 +1,57 @@
+package metrics
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chenleji/event-subscriber/events"
+	"github.com/chenleji/event-subscriber/locks"
+)
+
+func TestCollector(t *testing.T) {
+	c := NewCollector()
+	event := &events.Event{Name: "instance.start;handler=test"}
+	c.EventReceived(event)
+	c.EventReceived(event)
+	c.EventDropped(event, events.DropNoWorker)
+	for i := 0; i < 3; i++ {
+		c.HandlerStarted(event)
+	}
+	c.HandlerFinished(event, 20*time.Millisecond, errors.New("failed"))
+	c.HandlerFinished(event, time.Millisecond, events.Ignore("not mine"))
+	c.HandlerFinished(event, time.Millisecond, events.RequeueAfter(time.Second, errors.New("not yet")))
+	c.PongReceived()
+	contentions := locks.Contentions() + events.OrderedLockContentions()
+	locker := events.OrderedResourceLocker(0, nil)
+	locked := &events.Event{ResourceType: "instance", ResourceID: "1i1"}
+	unlocker := locker(locked).Lock()
+	defer unlocker.Unlock()
+	locker(locked).Lock()
+
+	rec := httptest.NewRecorder()
+	c.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	body := rec.Body.String()
+
+	for _, expected := range []string{
+		`event_subscriber_events_received_total{event="instance.start"} 2`,
+		`event_subscriber_events_dropped_total{event="instance.start",reason="no_worker"} 1`,
+		`event_subscriber_handler_errors_total{event="instance.start"} 1`,
+		`event_subscriber_handler_duration_seconds_bucket{event="instance.start",le="0.025"} 3`,
+		`event_subscriber_handler_duration_seconds_bucket{event="instance.start",le="0.01"} 2`,
+		`event_subscriber_handler_duration_seconds_count{event="instance.start"} 3`,
+		`event_subscriber_handlers_in_flight 0`,
+		`event_subscriber_publish_failures_total 0`,
+		`# TYPE event_subscriber_seconds_since_last_pong gauge`,
+		`event_subscriber_locks_held 1`,
+		`event_subscriber_events_parked 0`,
+		"event_subscriber_lock_contentions_total " + strconv.FormatUint(contentions+1, 10),
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("Expected metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
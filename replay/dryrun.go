@@ -0,0 +1,52 @@
+package replay
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/chenleji/event-subscriber/client"
+)
+
+// DryRunPublisher implements client.PublishOperations by keeping what handlers publish instead
+// of sending it to Cattle.
+type DryRunPublisher struct {
+	mu        sync.Mutex
+	published []*client.Publish
+}
+
+// NewDryRunClient returns a client whose publishes are captured by the returned publisher.
+// Other API calls go to base, which may be nil if the handlers make none.
+func NewDryRunClient(base client.GenericBaseClient) (*client.GenericClient, *DryRunPublisher) {
+	publisher := &DryRunPublisher{}
+	return &client.GenericClient{GenericBaseClient: base, Publish: publisher}, publisher
+}
+
+// Published returns the replies and progress updates captured so far, in order.
+func (p *DryRunPublisher) Published() []*client.Publish {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]*client.Publish{}, p.published...)
+}
+
+func (p *DryRunPublisher) Create(publish *client.Publish) (*client.Publish, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.published = append(p.published, publish)
+	return publish, nil
+}
+
+func (p *DryRunPublisher) List(opts *client.ListOpts) (*client.PublishCollection, error) {
+	return nil, errors.New("List is not supported in a dry run")
+}
+
+func (p *DryRunPublisher) Update(existing *client.Publish, updates interface{}) (*client.Publish, error) {
+	return nil, errors.New("Update is not supported in a dry run")
+}
+
+func (p *DryRunPublisher) ById(id string) (*client.Publish, error) {
+	return nil, errors.New("ById is not supported in a dry run")
+}
+
+func (p *DryRunPublisher) Delete(publish *client.Publish) error {
+	return errors.New("Delete is not supported in a dry run")
+}
@@ -0,0 +1,371 @@
+// Package replay feeds recorded events through an EventRouter, to reproduce
+// what a subscriber did with them without a Cattle server.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/chenleji/event-subscriber/events"
+	"github.com/chenleji/event-subscriber/journal"
+)
+
+// Config says what to replay and how.
+type Config struct {
+	// Path is a JSON Lines file of events, as Cattle sends them or as the journal records them.
+	Path string
+	// Names keeps only events whose name matches one of these, which may be patterns as in
+	// path.Match. Empty keeps every event.
+	Names []string
+	// Realtime waits between events for as long as passed between them when they were sent,
+	// according to their Time. Otherwise events are replayed as fast as the router takes them.
+	Realtime bool
+	// Pool is the worker pool to replay into. If nil, a realtime replay uses the router's
+	// default pool, and a fast one a pool that queues events instead of dropping them.
+	Pool events.WorkerPool
+	// WorkerCount is the size of the default fast replay pool.
+	WorkerCount int
+}
+
+// ReadEvents reads the events of a JSON Lines file, keeping those whose name matches one of
+// names. Of a journal, the received entries are read. Older journals have no received entries;
+// for those, outcome entries are used instead, except requeued ones, which have a later entry.
+// Malformed messages, which hold no event, are skipped.
+//
+// Outcome entries are written once the outcome of an event is known, so events are returned in
+// the order they were received in, by the receive time of their entry or, without one, by their
+// Time. Events with the same time keep the order of the file.
+func ReadEvents(r io.Reader, names []string) ([]*events.Event, error) {
+	type received struct {
+		event *events.Event
+		// at is in milliseconds, as Cattle event times are.
+		at      float64
+		outcome journal.Outcome
+		// key tells the entries of an event from those of other events.
+		key string
+	}
+	var read []received
+	// receivedKeys are the keys of the events with a received entry.
+	receivedKeys := map[string]bool{}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	line := 0
+	for scanner.Scan() {
+		line++
+		message := bytes.TrimSpace(scanner.Bytes())
+		if len(message) == 0 {
+			continue
+		}
+
+		entry := journal.Entry{}
+		if err := json.Unmarshal(message, &entry); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if entry.Outcome == journal.Malformed {
+			continue
+		}
+		if entry.Outcome != "" && len(entry.Event) > 0 {
+			if entry.Outcome == journal.Requeued {
+				continue
+			}
+			message = entry.Event
+		}
+
+		event := &events.Event{}
+		if err := json.Unmarshal(message, event); err != nil {
+			return nil, fmt.Errorf("line %d: %v", line, err)
+		}
+		if !matches(event.Name, names) {
+			continue
+		}
+		at := event.Time
+		if !entry.ReceivedAt.IsZero() {
+			at = float64(entry.ReceivedAt.UnixNano()) / float64(time.Millisecond)
+		}
+		// Events without an ID are told apart by their recorded form, which is the same in all
+		// their entries.
+		key := event.ID
+		if key == "" {
+			key = "\x00" + string(message)
+		}
+		if entry.Outcome == journal.Received {
+			receivedKeys[key] = true
+		}
+		read = append(read, received{event, at, entry.Outcome, key})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	kept := read[:0]
+	for _, r := range read {
+		if r.outcome == "" || r.outcome == journal.Received || !receivedKeys[r.key] {
+			kept = append(kept, r)
+		}
+	}
+	read = kept
+
+	sort.SliceStable(read, func(i, j int) bool {
+		return read[i].at < read[j].at
+	})
+	var result []*events.Event
+	for _, r := range read {
+		result = append(result, r.event)
+	}
+	return result, nil
+}
+
+func matches(name string, patterns []string) bool {
+	if len(patterns) == 0 {
+		return true
+	}
+	for _, pattern := range patterns {
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Source is an events.EventSource that delivers a list of events once. The stream ends with
+// io.EOF after the last one.
+type Source struct {
+	Events   []*events.Event
+	Realtime bool
+
+	// outstanding, if set, are waited for before the stream ends, since once it stops the
+	// router replies with an error to events still waiting to be requeued.
+	outstanding *outstanding
+	idle        time.Duration
+
+	mu   sync.Mutex
+	next int
+	// latest is the latest Time of the events delivered so far.
+	latest float64
+}
+
+func (s *Source) Connect(ctx context.Context, eventNames []string) (events.EventStream, error) {
+	return &stream{source: s, closed: make(chan struct{})}, nil
+}
+
+// take returns the next event and how long to wait before delivering it.
+func (s *Source) take() (*events.Event, time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.next >= len(s.Events) {
+		return nil, 0, false
+	}
+	event := s.Events[s.next]
+	var wait time.Duration
+	// Waiting from the latest time rather than the previous event's keeps an event whose Time is
+	// a little behind from shortening the waits that follow it.
+	if s.Realtime && s.latest > 0 && event.Time > s.latest {
+		// Cattle event times are in milliseconds.
+		wait = time.Duration((event.Time - s.latest) * float64(time.Millisecond))
+	}
+	if event.Time > s.latest {
+		s.latest = event.Time
+	}
+	s.next++
+	return event, wait, true
+}
+
+type stream struct {
+	source    *Source
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func (s *stream) Next() (*events.Event, error) {
+	event, wait, ok := s.source.take()
+	if !ok {
+		if s.source.outstanding != nil {
+			s.source.outstanding.wait(s.closed, s.source.idle)
+		}
+		return nil, io.EOF
+	}
+	select {
+	case <-s.closed:
+		return nil, io.ErrClosedPipe
+	case <-time.After(wait):
+	}
+	return event, nil
+}
+
+func (s *stream) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.closed)
+	})
+	return nil
+}
+
+// outstanding is an events.Observer that tracks the events received but not yet finished with,
+// including those waiting to be requeued.
+type outstanding struct {
+	events.NopObserver
+	mu      sync.Mutex
+	pending map[*events.Event]bool
+	// changed is closed, and replaced, whenever an event is finished with.
+	changed chan struct{}
+}
+
+func newOutstanding() *outstanding {
+	return &outstanding{pending: map[*events.Event]bool{}, changed: make(chan struct{})}
+}
+
+func (o *outstanding) EventReceived(event *events.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.pending[event] = true
+}
+
+func (o *outstanding) EventDropped(event *events.Event, reason events.DropReason) {
+	o.finish(event)
+}
+
+func (o *outstanding) HandlerFinished(event *events.Event, duration time.Duration, err error) {
+	// A requeue past the router's MaxRequeues finishes with a permanent error instead.
+	if journal.HandlerOutcome(err) != journal.Requeued {
+		o.finish(event)
+	}
+}
+
+func (o *outstanding) finish(event *events.Event) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if o.pending[event] {
+		delete(o.pending, event)
+		close(o.changed)
+		o.changed = make(chan struct{})
+	}
+}
+
+// wait returns once every event is finished with, once closed is, or once no event has been
+// finished with for idle.
+func (o *outstanding) wait(closed <-chan struct{}, idle time.Duration) {
+	for {
+		o.mu.Lock()
+		if len(o.pending) == 0 {
+			o.mu.Unlock()
+			return
+		}
+		changed := o.changed
+		o.mu.Unlock()
+		select {
+		case <-changed:
+		case <-closed:
+			return
+		case <-time.After(idle):
+			return
+		}
+	}
+}
+
+// Replay runs router over the events of config.Path and returns a report of what became of
+// them. The router must not have been started. Events requeued with RequeueAfter are run again,
+// up to the router's MaxRequeues, before the replay ends, as a live router would.
+func Replay(ctx context.Context, router *events.EventRouter, config Config) (*Report, error) {
+	file, err := os.Open(config.Path)
+	if err != nil {
+		return nil, err
+	}
+	recorded, err := ReadEvents(file, config.Names)
+	file.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(router.KnownEventNames) == 0 {
+		// Expand handler patterns against the recorded names rather than the API schemas.
+		for _, event := range recorded {
+			router.KnownEventNames = append(router.KnownEventNames, event.Name)
+		}
+	}
+	pending := newOutstanding()
+	// A handler that makes no progress for as long as the router would drain it is left to
+	// the drain.
+	router.Source = &Source{Events: recorded, Realtime: config.Realtime, outstanding: pending, idle: router.DrainTimeout}
+	router.ReconnectConfig.MaxRetries = 0
+	report := NewReport()
+	router.AddObserver(report)
+	router.AddObserver(pending)
+
+	pool := config.Pool
+	if pool == nil && !config.Realtime {
+		workers := config.WorkerCount
+		if workers <= 0 {
+			workers = 1
+		}
+		pool = events.QueueingWorkerPool(workers, workers, events.BlockWithTimeout(time.Hour), events.OrderedResourceLocker(0, nil))
+	}
+	if pool == nil {
+		err = router.Run(ctx)
+	} else {
+		err = router.RunWorkerPool(ctx, pool)
+	}
+	if exitErr, ok := err.(*events.ExitError); ok && exitErr.Reason == events.ExitEndOfEvents {
+		err = nil
+	}
+	return report, err
+}
+
+// Main is a replay command for a binary that registers its own handlers. It adds its flags to
+// flags, which may already have the binary's own, parses args and only then calls handlers for
+// the handlers to replay with and the timeouts they override. It replays a file offline,
+// capturing replies, and prints the report and, with -replies, what was published.
+func Main(flags *flag.FlagSet, args []string, handlers func() (map[string]events.EventHandler, map[string]time.Duration, error), stdout io.Writer) error {
+	file := flags.String("file", "", "JSON Lines file of events to replay")
+	names := flags.String("names", "", "comma separated event names or patterns to replay; all if empty")
+	realtime := flags.Bool("realtime", false, "wait between events as long as when they were recorded")
+	workers := flags.Int("workers", 10, "number of workers")
+	replies := flags.Bool("replies", false, "print the replies handlers published")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+	if *file == "" {
+		return fmt.Errorf("-file is required")
+	}
+	eventHandlers, timeouts, err := handlers()
+	if err != nil {
+		return err
+	}
+
+	apiClient, publisher := NewDryRunClient(nil)
+	router, err := events.NewEventRouter(apiClient, *workers, eventHandlers)
+	if err != nil {
+		return err
+	}
+	router.HandlerTimeouts = timeouts
+	config := Config{Path: *file, Realtime: *realtime, WorkerCount: *workers}
+	if *names != "" {
+		config.Names = strings.Split(*names, ",")
+	}
+
+	report, err := Replay(context.Background(), router, config)
+	if err != nil {
+		return err
+	}
+	if err := report.Write(stdout); err != nil {
+		return err
+	}
+	if *replies {
+		encoder := json.NewEncoder(stdout)
+		for _, publish := range publisher.Published() {
+			if err := encoder.Encode(publish); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
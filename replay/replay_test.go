@@ -0,0 +1,167 @@
+package replay
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/chenleji/event-subscriber/client"
+	"github.com/chenleji/event-subscriber/events"
+	"github.com/chenleji/event-subscriber/journal"
+)
+
+const recorded = `{"name":"instance.start","id":"1","replyTo":"reply.1","resourceId":"1i1","resourceType":"instance","time":1000}
+{"receivedAt":"2017-01-01T00:00:00Z","outcome":"requeued","event":{"name":"instance.start","id":"2","resourceId":"1i2","time":1010}}
+{"receivedAt":"2017-01-01T00:00:00Z","outcome":"handled","event":{"name":"instance.start","id":"2","replyTo":"reply.2","resourceId":"1i2","resourceType":"instance","time":1050}}
+
+{"name":"instance.stop","id":"3","replyTo":"reply.3","resourceId":"1i1","resourceType":"instance","time":1060}
+{"name":"host.create","id":"4","time":1070}
+`
+
+func TestReplay(t *testing.T) {
+	file, err := ioutil.TempFile("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(recorded)
+	file.Close()
+
+	handlers := map[string]events.EventHandler{
+		"instance.start": events.ReplyingWithData(func(event *events.Event, apiClient *client.GenericClient) (map[string]interface{}, error) {
+			return map[string]interface{}{"started": event.ResourceID}, nil
+		}),
+		"instance.stop": func(event *events.Event, apiClient *client.GenericClient) error {
+			return events.Permanent(nil)
+		},
+	}
+	apiClient, publisher := NewDryRunClient(nil)
+	router, err := events.NewEventRouter(apiClient, 2, handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	report, err := Replay(context.Background(), router, Config{
+		Path:     file.Name(),
+		Names:    []string{"instance.*"},
+		Realtime: true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 60*time.Millisecond {
+		t.Errorf("Expected the replay to be paced by event time, took %v", elapsed)
+	}
+
+	if count := report.Count("instance.start", journal.Handled); count != 2 {
+		t.Errorf("Expected 2 handled instance.start, got %v", count)
+	}
+	if count := report.Count("instance.stop", journal.Failed); count != 1 {
+		t.Errorf("Expected 1 failed instance.stop, got %v", count)
+	}
+	if count := report.Count("host.create", journal.NoHandler); count != 0 {
+		t.Errorf("Expected host.create to be filtered out, got %v", count)
+	}
+	if published := publisher.Published(); len(published) != 3 {
+		t.Errorf("Expected 2 replies and an error reply, got %v", len(published))
+	}
+
+	out := &bytes.Buffer{}
+	report.Write(out)
+	if !strings.Contains(out.String(), "3 event(s) replayed") {
+		t.Errorf("Unexpected report:\n%s", out)
+	}
+}
+
+// An event still waiting to be requeued when the file ends should run again, not fail.
+func TestReplayRequeue(t *testing.T) {
+	file, err := ioutil.TempFile("", "replay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString(`{"name":"instance.start","id":"1","replyTo":"reply.1","resourceId":"1i1","resourceType":"instance"}` + "\n")
+	file.Close()
+
+	attempts := 0
+	handlers := map[string]events.EventHandler{
+		"instance.start": func(event *events.Event, apiClient *client.GenericClient) error {
+			attempts++
+			if attempts < 3 {
+				return events.RequeueAfter(10*time.Millisecond, errors.New("not yet"))
+			}
+			return nil
+		},
+	}
+	apiClient, _ := NewDryRunClient(nil)
+	router, err := events.NewEventRouter(apiClient, 2, handlers)
+	if err != nil {
+		t.Fatal(err)
+	}
+	report, err := Replay(context.Background(), router, Config{Path: file.Name()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if handled, requeued := report.Count("instance.start", journal.Handled), report.Count("instance.start", journal.Requeued); handled != 1 || requeued != 2 {
+		t.Errorf("Expected 2 requeues and then success, got %v handled and %v requeued", handled, requeued)
+	}
+	if count := report.Count("instance.start", journal.DroppedDraining); count != 0 {
+		t.Errorf("Expected no requeued event to be drained, got %v", count)
+	}
+}
+
+func TestReadEventsOrder(t *testing.T) {
+	// The slow event 1 was received before event 2 but finished after it. Event 3 has no receive
+	// time, so its Time places it.
+	journaled := `{"receivedAt":"2017-01-01T00:00:01Z","outcome":"handled","event":{"name":"instance.stop","id":"2","time":900}}
+{"receivedAt":"2017-01-01T00:00:00Z","outcome":"handled","event":{"name":"instance.start","id":"1","time":1000}}
+{"outcome":"dropped-locked","event":{"name":"instance.start","id":"3","time":1483228800500}}
+`
+	read, err := ReadEvents(strings.NewReader(journaled), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, event := range read {
+		ids = append(ids, event.ID)
+	}
+	if strings.Join(ids, ",") != "1,3,2" {
+		t.Errorf("Expected events in the order they were received, got %v", ids)
+	}
+
+	// Event 4 has a received entry, so its outcome entry is not replayed again.
+	withReceived := journaled + `{"receivedAt":"2017-01-01T00:00:02Z","outcome":"received","event":{"name":"instance.start","id":"4"}}
+{"receivedAt":"2017-01-01T00:00:02Z","outcome":"handled","event":{"name":"instance.start","id":"4"}}
+`
+	if read, err := ReadEvents(strings.NewReader(withReceived), nil); err != nil || len(read) != 4 || read[3].ID != "4" {
+		t.Errorf("Expected event 4 to be read once, from its received entry, got %v %v", read, err)
+	}
+
+	// Events without an ID are matched to their received entry by their recorded form.
+	withoutIDs := `{"receivedAt":"2017-01-01T00:00:00Z","outcome":"received","event":{"name":"instance.start"}}
+{"receivedAt":"2017-01-01T00:00:00Z","outcome":"handled","event":{"name":"instance.start"}}
+{"receivedAt":"2017-01-01T00:00:01Z","outcome":"handled","event":{"name":"instance.stop"}}
+`
+	if read, err := ReadEvents(strings.NewReader(withoutIDs), nil); err != nil || len(read) != 2 || read[1].Name != "instance.stop" {
+		t.Errorf("Expected each event without an ID to be read once, got %v %v", read, err)
+	}
+
+	source := &Source{Realtime: true, Events: []*events.Event{{Time: 1000}, {Time: 900}, {Time: 1100}}}
+	var waits []time.Duration
+	for {
+		_, wait, ok := source.take()
+		if !ok {
+			break
+		}
+		waits = append(waits, wait)
+	}
+	if waits[1] != 0 || waits[2] != 100*time.Millisecond {
+		t.Errorf("Expected waits from the latest event time, got %v", waits)
+	}
+}
@@ -0,0 +1,97 @@
+package replay
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/chenleji/event-subscriber/events"
+	"github.com/chenleji/event-subscriber/journal"
+)
+
+// Report is an events.Observer that counts the outcomes of replayed events, per event name.
+type Report struct {
+	events.NopObserver
+	mu       sync.Mutex
+	outcomes map[string]map[journal.Outcome]int
+	received int
+}
+
+func NewReport() *Report {
+	return &Report{outcomes: map[string]map[journal.Outcome]int{}}
+}
+
+func (r *Report) EventReceived(event *events.Event) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.received++
+}
+
+func (r *Report) EventDropped(event *events.Event, reason events.DropReason) {
+	r.add(event.Name, journal.DropOutcome(reason))
+}
+
+func (r *Report) HandlerFinished(event *events.Event, duration time.Duration, err error) {
+	r.add(event.Name, journal.HandlerOutcome(err))
+}
+
+func (r *Report) add(name string, outcome journal.Outcome) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.outcomes[name] == nil {
+		r.outcomes[name] = map[journal.Outcome]int{}
+	}
+	r.outcomes[name][outcome]++
+}
+
+// Count returns how many events named name had outcome.
+func (r *Report) Count(name string, outcome journal.Outcome) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.outcomes[name][outcome]
+}
+
+// Write prints a table of outcomes per event name to w.
+func (r *Report) Write(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	names := []string{}
+	seen := map[journal.Outcome]bool{}
+	for name, outcomes := range r.outcomes {
+		names = append(names, name)
+		for outcome := range outcomes {
+			seen[outcome] = true
+		}
+	}
+	sort.Strings(names)
+	columns := []journal.Outcome{}
+	for outcome := range seen {
+		columns = append(columns, outcome)
+	}
+	sort.Slice(columns, func(i, j int) bool {
+		return columns[i] < columns[j]
+	})
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprint(tw, "EVENT")
+	for _, outcome := range columns {
+		fmt.Fprintf(tw, "\t%s", outcome)
+	}
+	fmt.Fprintln(tw)
+	for _, name := range names {
+		fmt.Fprint(tw, name)
+		for _, outcome := range columns {
+			fmt.Fprintf(tw, "\t%d", r.outcomes[name][outcome])
+		}
+		fmt.Fprintln(tw)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d event(s) replayed\n", r.received)
+	return err
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/chenleji/event-subscriber/client"
+	"github.com/chenleji/event-subscriber/config"
+	"github.com/chenleji/event-subscriber/events"
+	"github.com/chenleji/event-subscriber/journal"
+	"github.com/chenleji/event-subscriber/metrics"
+	"github.com/chenleji/event-subscriber/replay"
+)
+
+// eventHandlers returns the handlers the subscriber always has, unless a route overrides them.
+func eventHandlers() map[string]events.EventHandler {
+	return map[string]events.EventHandler{
+		"ping": events.Replying(pong),
+	}
+}
+
+// execFlags collects repeated "-exec name=command" flags. The command is split on spaces.
+type execFlags map[string]string
+
+func (f execFlags) String() string {
+	pairs := []string{}
+	for name, command := range f {
+		pairs = append(pairs, name+"="+command)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f execFlags) Set(value string) error {
+	parts := strings.SplitN(value, "=", 2)
+	if len(parts) != 2 || parts[0] == "" || strings.TrimSpace(parts[1]) == "" {
+		return fmt.Errorf("expected name=command, got %q", value)
+	}
+	f[parts[0]] = parts[1]
+	return nil
+}
+
+func (f execFlags) routes(timeout time.Duration, maxConcurrent int) []config.Route {
+	routes := []config.Route{}
+	for name, command := range f {
+		fields := strings.Fields(command)
+		routes = append(routes, config.Route{
+			Event:   name,
+			Handler: config.KindExec,
+			Exec: &config.ExecRoute{
+				Command:       fields[0],
+				Args:          fields[1:],
+				TimeoutMillis: int(timeout / time.Millisecond),
+				MaxConcurrent: maxConcurrent,
+			},
+		})
+	}
+	return routes
+}
+
+// withoutEvents returns routes without those for the events that commands handle, so that the
+// -exec flags replace the routes of the config file rather than add to them.
+func withoutEvents(routes []config.Route, commands execFlags) []config.Route {
+	kept := []config.Route{}
+	for _, route := range routes {
+		if _, ok := commands[route.Event]; !ok {
+			kept = append(kept, route)
+		}
+	}
+	return kept
+}
+
+// pong answers Cattle's pings so that it knows the subscriber is alive.
+func pong(event *events.Event, apiClient *client.GenericClient) (*events.ReplyEvent, error) {
+	return events.NewReplyEvent(event.ReplyTo, event.ID), nil
+}
+
+// routeFlags adds the flags that say which handler each event goes to, and returns a function
+// that loads the configuration they describe once the flags are parsed. The configuration is
+// not validated, so that other flags can still override it.
+func routeFlags(flags *flag.FlagSet) func() (*config.Config, error) {
+	configPath := flags.String("config", "", "JSON or YAML file describing the connection, workers and routes; flags given here override it")
+	commands := execFlags{}
+	flags.Var(commands, "exec", "handle events named name with a command, as name=command; may be repeated")
+	execTimeout := flags.Duration("exec-timeout", 0, "how long a command may run; 0 leaves it to the event's timeout")
+	execConcurrency := flags.Int("exec-concurrency", 0, "how many instances of each command may run at once; 0 is unlimited")
+	return func() (*config.Config, error) {
+		cfg := config.Default()
+		if *configPath != "" {
+			var err error
+			if cfg, err = config.Load(*configPath); err != nil {
+				return nil, err
+			}
+		}
+		cfg.Routes = append(withoutEvents(cfg.Routes, commands), commands.routes(*execTimeout, *execConcurrency)...)
+		return cfg, nil
+	}
+}
+
+func runCommand(args []string) error {
+	flags := flag.NewFlagSet("run", flag.ContinueOnError)
+	loadConfig := routeFlags(flags)
+	url := flags.String("url", "", "Cattle API URL, or $CATTLE_URL")
+	accessKey := flags.String("access-key", "", "Cattle access key, or $CATTLE_ACCESS_KEY")
+	secretKey := flags.String("secret-key", "", "Cattle secret key, or $CATTLE_SECRET_KEY")
+	workers := flags.Int("workers", 10, "number of workers handling events")
+	handlerName := flags.String("handler-name", "", "subscribe only to events addressed to this handler")
+	listen := flags.String("listen", "", "address to serve /metrics, /live and /ready on, for example localhost:9108")
+	journalPath := flags.String("journal", "", "file to record received events and their outcomes to")
+	journalMaxSize := flags.Int("journal-max-size", config.DefaultJournalMaxSizeMB, "megabytes the journal grows to before it is rotated; 0 is no limit")
+	journalMaxAge := flags.Duration("journal-max-age", 0, "how long the journal is written to before it is rotated; 0 is no limit")
+	journalMaxBackups := flags.Int("journal-max-backups", config.DefaultJournalMaxBackups, "how many rotated journals are kept; 0 keeps them all")
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	cfg, err := loadConfig()
+	if err != nil {
+		return err
+	}
+	flags.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "url":
+			cfg.API.URL = *url
+		case "access-key":
+			cfg.API.AccessKey = *accessKey
+		case "secret-key":
+			cfg.API.SecretKey = *secretKey
+		case "workers":
+			cfg.Workers.Size = *workers
+		case "journal":
+			cfg.Journal.Path = *journalPath
+		case "journal-max-size":
+			cfg.Journal.MaxSizeMB = *journalMaxSize
+		case "journal-max-age":
+			cfg.Journal.MaxAgeMillis = int(*journalMaxAge / time.Millisecond)
+		case "journal-max-backups":
+			cfg.Journal.MaxBackups = *journalMaxBackups
+		}
+	})
+	if err := cfg.Validate(); err != nil {
+		return err
+	}
+
+	router, err := cfg.NewRouter(eventHandlers())
+	if err != nil {
+		return err
+	}
+
+	if cfg.Journal.Path != "" {
+		recorder, err := journal.NewRecorder(cfg.JournalConfig())
+		if err != nil {
+			return err
+		}
+		defer recorder.Close()
+		router.AddObserver(recorder)
+	}
+	if *listen != "" {
+		collector := metrics.NewCollector()
+		router.AddObserver(collector)
+		health := events.NewHealthHandler(router)
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", collector)
+		mux.Handle("/live", health)
+		mux.Handle("/ready", health)
+		go func() {
+			logrus.Fatal(http.ListenAndServe(*listen, mux))
+		}()
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		logrus.Infof("Received %v, shutting down", sig)
+		cancel()
+	}()
+
+	wp := cfg.WorkerPool()
+	if *handlerName != "" {
+		err = router.RunHandlerWorkerPool(ctx, *handlerName, wp)
+	} else {
+		err = router.RunWorkerPool(ctx, wp)
+	}
+	if events.IsCancelled(err) {
+		return nil
+	}
+	return err
+}
+
+// replayCommand replays recorded events offline through the handlers that run would route
+// them to.
+func replayCommand(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ContinueOnError)
+	loadConfig := routeFlags(flags)
+	return replay.Main(flags, args, func() (map[string]events.EventHandler, map[string]time.Duration, error) {
+		cfg, err := loadConfig()
+		if err != nil {
+			return nil, nil, err
+		}
+		if err := cfg.Validate(); err != nil {
+			return nil, nil, err
+		}
+		routed, timeouts := cfg.HandlersWith(eventHandlers())
+		return routed, timeouts, nil
+	}, os.Stdout)
+}
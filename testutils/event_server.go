@@ -3,6 +3,7 @@ package testUtils
 import (
 	"io"
 	"io/ioutil"
+	"net"
 	"net/http"
 	"sync"
 
@@ -11,6 +12,8 @@ import (
 )
 
 var subscriberChannels []chan string
+var subscriptionCount int
+var subscribedEventNames []string
 var mu sync.RWMutex
 
 var pingHandler func(appData string) error
@@ -26,9 +29,25 @@ func ResetTestServer() {
 		close(channel)
 	}
 	subscriberChannels = subscriberChannels[:0]
+	subscriptionCount = 0
+	subscribedEventNames = nil
 	pingHandler = nil
 }
 
+// SubscriptionCount returns how many times a client has subscribed since the last reset.
+func SubscriptionCount() int {
+	mu.RLock()
+	defer mu.RUnlock()
+	return subscriptionCount
+}
+
+// SubscribedEventNames returns the event names of the most recent subscription.
+func SubscribedEventNames() []string {
+	mu.RLock()
+	defer mu.RUnlock()
+	return subscribedEventNames
+}
+
 func publishHandler(w http.ResponseWriter, req *http.Request) {
 	io.WriteString(w, "A response.")
 }
@@ -62,6 +81,8 @@ func subscribeHandler(w http.ResponseWriter, req *http.Request) {
 	resultChan := make(chan string)
 	mu.Lock()
 	subscriberChannels = append(subscriberChannels, resultChan)
+	subscriptionCount++
+	subscribedEventNames = req.URL.Query()["eventNames"]
 	mu.Unlock()
 
 	writeEventToSubscriber(ws, resultChan)
@@ -80,7 +101,11 @@ func pushToSubscribers(message string) {
 
 func writeEventToSubscriber(ws *websocket.Conn, c chan string) {
 	for {
-		event := <-c
+		event, ok := <-c
+		if !ok {
+			// The test server was reset.
+			return
+		}
 		if event != "" {
 			err := ws.WriteMessage(websocket.TextMessage, []byte(event))
 			if err != nil {
@@ -99,19 +124,11 @@ func InitializeServer(port string, ready chan string) (err error) {
 	http.HandleFunc("/publish", publishHandler)
 	http.HandleFunc("/pushEvent", pushEventHandler)
 	http.HandleFunc("/ready", readyHandler)
-	go http.ListenAndServe(":"+port, nil)
-
-	readyURL := "http://localhost:" + port + "/pushEvent"
-	for {
-		resp, err := http.Post(readyURL, "application/json", nil)
-		// TODO This was added when I was debuggin. Might not need it now.
-		if err == nil {
-			log.Println(resp.Status)
-			break
-		} else {
-			log.Fatal(err)
-		}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		log.Fatal(err)
 	}
+	go http.Serve(listener, nil)
 
 	ready <- "Ready!"
 	return nil